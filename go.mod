@@ -7,6 +7,7 @@ require (
 	github.com/aws/aws-sdk-go v1.44.214
 	github.com/hashicorp/go-multierror v1.1.1
 	golang.org/x/crypto v0.7.0
+	golang.org/x/term v0.6.0
 )
 
 require (
@@ -5,6 +5,7 @@ import (
 	"io"
 	"os"
 	"os/exec"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -91,11 +92,39 @@ func (h *helper) prepareClerk(a *annexremote.Responder) error {
 		if err != nil {
 			return err
 		}
+		if err := loadPolicy(a, clerk); err != nil {
+			return err
+		}
 		h.ClerkMaybe = clerk
 	}
 	return nil
 }
 
+// the newest policy serial seen from the space is kept in git-annex's state for this remote, so that rollbacks are
+// detected
+const policySerialState = "policy-serial"
+
+func loadPolicy(a *annexremote.Responder, clerk *cryptapi.Clerk) error {
+	var lastSerial uint64
+	state, err := a.GetState(policySerialState)
+	if err != nil {
+		return err
+	}
+	if state != "" {
+		if lastSerial, err = strconv.ParseUint(state, 10, 64); err != nil {
+			return fmt.Errorf("invalid policy serial in remote state: %q", state)
+		}
+	}
+	serial, err := clerk.LoadPolicy(lastSerial)
+	if err != nil {
+		return err
+	}
+	if serial > lastSerial {
+		return a.SetState(policySerialState, strconv.FormatUint(serial, 10))
+	}
+	return nil
+}
+
 func (h *helper) getClerk() (*cryptapi.Clerk, error) {
 	h.ClerkLock.Lock()
 	defer h.ClerkLock.Unlock()
@@ -341,8 +370,30 @@ func (h *helper) unlockKey(a *annexremote.Responder, key string) {
 }
 
 // reproducible filename hash
-func keyToInfix(clerk *cryptapi.Clerk, key string) string {
-	return "upload-" + clerk.HMAC(key)
+func keyToInfix(clerk *cryptapi.Clerk, key string) (string, error) {
+	mac, err := clerk.HMAC(key)
+	if err != nil {
+		return "", err
+	}
+	return "upload-" + mac, nil
+}
+
+// keyToInfixes lists every infix that the key might have been stored under, including those from before a rekey and
+// opaque infixes.
+func keyToInfixes(clerk *cryptapi.Clerk, key string) ([]string, error) {
+	macs, err := clerk.HMACs(key)
+	if err != nil {
+		return nil, err
+	}
+	var infixes []string
+	for _, mac := range macs {
+		objectInfixes, err := clerk.ObjectInfixes("upload-" + mac)
+		if err != nil {
+			return nil, err
+		}
+		infixes = append(infixes, objectInfixes...)
+	}
+	return infixes, nil
 }
 
 func (h *helper) locateFile(key string) (path string, err error) {
@@ -350,12 +401,22 @@ func (h *helper) locateFile(key string) (path string, err error) {
 	if err != nil {
 		return "", err
 	}
-	cryptedFilename := keyToInfix(clerk, key)
-	// first do a check to see if we've already located the file, without any network traffic
-	metadata, found, err := h.getObjectMetadata(cryptedFilename)
+	infixes, err := keyToInfixes(clerk, key)
 	if err != nil {
 		return "", err
 	}
+	var metadata ObjectMetadata
+	var found bool
+	for _, cryptedFilename := range infixes {
+		// first do a check to see if we've already located the file, without any network traffic
+		metadata, found, err = h.getObjectMetadata(cryptedFilename)
+		if err != nil {
+			return "", err
+		}
+		if found {
+			break
+		}
+	}
 	if !found {
 		// not found
 		return "", nil
@@ -438,6 +499,13 @@ func (h *helper) TransferStore(a *annexremote.Responder, key string, tempfilepat
 		// already exists on the remote! no need to upload!
 		return nil
 	}
+	infix, err := keyToInfix(clerk, key)
+	if err != nil {
+		return err
+	}
+	if err := clerk.CheckUpload(infix); err != nil {
+		return err
+	}
 	f, err := os.Open(tempfilepath)
 	if err != nil {
 		return err
@@ -447,7 +515,15 @@ func (h *helper) TransferStore(a *annexremote.Responder, key string, tempfilepat
 			err = multierror.Append(err, err2)
 		}
 	}()
-	newPath, err := clerk.PutEncryptObjectStream(keyToInfix(clerk, key), f)
+	stat, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	newPath, err := clerk.PutEncryptObjectStreamWithInfo(infix, f, cryptapi.ObjectInfo{
+		Kind:     cryptapi.KindAnnex,
+		AnnexKey: key,
+		Length:   stat.Size(),
+	})
 	if err != nil {
 		return err
 	}
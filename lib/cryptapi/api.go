@@ -2,6 +2,7 @@ package cryptapi
 
 import (
 	"bytes"
+	"crypto/ed25519"
 	"crypto/hmac"
 	"crypto/sha256"
 	"encoding/binary"
@@ -11,50 +12,127 @@ import (
 	"fmt"
 	"golang.org/x/crypto/sha3"
 	"io"
-	"io/ioutil"
 	"net/http"
 	"os"
 	"strings"
+	"time"
 
 	"filippo.io/age"
 	"github.com/celskeggs/nightmarket/lib/demonapi"
+	"github.com/celskeggs/nightmarket/lib/util"
 	"github.com/hashicorp/go-multierror"
 )
 
-const Version = 1
+// object format versions: each object is written with the oldest version that supports the features it uses, so that
+// older clients can continue to read it.
+const (
+	VersionPlain  = 1
+	VersionSigned = 2
+	// from this version on, the header explicitly states whether the object is compressed and whether it is signed
+	VersionCompressed = 3
+	VersionPadded     = 4
+	VersionNamed      = 5
+	// from this version on, readers honor the minimum version and required features in util.Compatibility
+	VersionFeatures = 6
+)
+
+// Version is the newest object format that this client can read.
+const Version = VersionFeatures
+
+// objectFeatures lists the required features that this client understands. (No features have been defined yet.)
+var objectFeatures []string
 
 type ClerkConfig struct {
 	SecretKey   string               `json:"secret-key"`
 	SpaceConfig demonapi.ClerkConfig `json:"space"`
 	WorkFactor  int                  `json:"age-work-factor"`
+	// if set, the secret key and device token are supplied from elsewhere instead of the configuration file
+	SecretKeySource *SecretSource `json:"secret-key-source,omitempty"`
+	TokenSource     *SecretSource `json:"token-source,omitempty"`
+	// if an identity is configured, objects are encrypted to the devices in the signed roster instead of to the
+	// shared secret key. (the secret key is still used for filename infixes and to read older objects.)
+	Identity string        `json:"identity,omitempty"`
+	AdminKey string        `json:"admin-key,omitempty"`
+	Roster   *SignedRoster `json:"roster,omitempty"`
+	// if a signing key is configured, objects are signed so that other devices can verify their origin
+	SigningKey        string `json:"signing-key,omitempty"`
+	RequireSignatures bool   `json:"require-signatures,omitempty"`
+	// the epoch of SecretKey, which increases each time the key is rotated
+	Epoch   int        `json:"epoch,omitempty"`
+	Keyring []KeyEpoch `json:"keyring,omitempty"`
+	// if set, scrypt runs once when the configuration is loaded to derive a long-term key, rather than once per object
+	DeriveKeyOnce bool `json:"derive-key-once,omitempty"`
+	// how subkeys are derived from the secret key; see KeyVersionSubkeys
+	KeyVersion int `json:"key-version,omitempty"`
+	// compression to apply to uploads when it helps; see CompressionDeflate
+	Compression string `json:"compression,omitempty"`
+	// padding to apply to uploads to hide their exact sizes; see PaddingPadme
+	Padding string `json:"padding,omitempty"`
+	// if set, new objects are stored under opaque infixes that hide their names; see IsOpaqueInfix
+	OpaqueNames bool `json:"opaque-names,omitempty"`
+	// if set, this device is registered with the watchdemon server under an alias sealed with this key, which every
+	// device in the space must share so that it can tell which device stored an object; see DeviceAlias
+	DeviceAliasKey string `json:"device-alias-key,omitempty"`
+	// if set, the space must have a policy signed by AdminKey, so that it cannot be lifted by deleting it; see Policy
+	RequirePolicy bool `json:"require-policy,omitempty"`
 }
 
 type Clerk struct {
 	RemoteClerk demonapi.Clerk
 	Config      ClerkConfig
+	// populated only when a roster is configured
+	Roster     *Roster
+	identity   *age.X25519Identity
+	recipients []age.Recipient
+	signingKey ed25519.PrivateKey
+	// populated only when DeriveKeyOnce is set
+	derivedRecipient *derivedRecipient
+	derived          derivedKeys
+	// populated by LoadPolicy, only when an admin key is configured and the administrator has published a policy
+	Policy       *Policy
+	policyLoaded bool
 }
 
-func LoadConfig(configPath string) (*Clerk, error) {
+// ReadConfig reads a configuration file without validating it or resolving any secret sources. The file may be
+// encrypted with age, in which case it is decrypted; see ConfigIdentityEnv.
+func ReadConfig(configPath string) (ClerkConfig, error) {
 	fi, err := os.Stat(configPath)
 	if err != nil {
-		return nil, err
+		return ClerkConfig{}, err
 	}
 	if (fi.Mode() & os.ModePerm) != 0o600 {
-		return nil, fmt.Errorf(
+		return ClerkConfig{}, fmt.Errorf(
 			"configuration %q is not protected from other users: chmod it to 0600 for safety", configPath)
 	}
 	configData, err := os.ReadFile(configPath)
 	if err != nil {
-		return nil, err
+		return ClerkConfig{}, err
+	}
+	if isEncrypted(configData) {
+		if configData, err = decryptConfig(configPath, configData); err != nil {
+			return ClerkConfig{}, err
+		}
 	}
 	var config ClerkConfig
 	if err = json.Unmarshal(configData, &config); err != nil {
+		return ClerkConfig{}, err
+	}
+	return config, nil
+}
+
+func LoadConfig(configPath string) (*Clerk, error) {
+	config, err := ReadConfig(configPath)
+	if err != nil {
 		return nil, err
 	}
 	return NewClerk(config)
 }
 
 func NewClerk(config ClerkConfig) (*Clerk, error) {
+	config, err := resolveSecrets(config)
+	if err != nil {
+		return nil, err
+	}
 	if len(config.SecretKey) == 0 {
 		return nil, errors.New("invalid secret key: length is 0")
 	}
@@ -63,29 +141,136 @@ func NewClerk(config ClerkConfig) (*Clerk, error) {
 	if config.WorkFactor > 22 || config.WorkFactor < 0 {
 		return nil, errors.New("invalid work factor")
 	}
-	return &Clerk{
+	if err := validateKeyring(config); err != nil {
+		return nil, err
+	}
+	if err := validateKeyVersion(config.KeyVersion); err != nil {
+		return nil, err
+	}
+	if err := validateCompression(config.Compression); err != nil {
+		return nil, err
+	}
+	if err := validatePadding(config.Padding); err != nil {
+		return nil, err
+	}
+	c := &Clerk{
 		RemoteClerk: demonapi.Clerk{
 			Client: http.Client{},
 			Config: config.SpaceConfig,
 		},
 		Config: config,
-	}, nil
+	}
+	if config.DeviceAliasKey != "" {
+		alias, err := DeviceAlias(config.DeviceAliasKey, config.SpaceConfig.DeviceName)
+		if err != nil {
+			return nil, err
+		}
+		c.RemoteClerk.Config.DeviceAlias = alias
+	}
+	// a roster from the policy replaces this one once the policy is loaded, and may be the only roster available
+	if config.Roster != nil || (c.needsRoster() && config.AdminKey == "") {
+		if err := c.loadRoster(); err != nil {
+			return nil, err
+		}
+	}
+	if config.DeriveKeyOnce {
+		d := c.currentDerivation()
+		identity, err := c.derivedIdentity(d)
+		if err != nil {
+			return nil, err
+		}
+		c.derivedRecipient = &derivedRecipient{
+			derivation: d,
+			recipient:  identity.Recipient(),
+		}
+	}
+	return c, nil
+}
+
+func (c *Clerk) encryptionRecipients() ([]age.Recipient, error) {
+	if c.recipients != nil {
+		return c.recipients, nil
+	}
+	return c.sharedRecipients()
+}
+
+// sharedRecipients returns the recipients for the shared secret key, which every device in the space holds.
+func (c *Clerk) sharedRecipients() ([]age.Recipient, error) {
+	if c.derivedRecipient != nil {
+		return []age.Recipient{*c.derivedRecipient}, nil
+	}
+	pass, err := passphrase(c.Config.SecretKey, c.Config.KeyVersion)
+	if err != nil {
+		return nil, err
+	}
+	recipient, err := age.NewScryptRecipient(pass)
+	if err != nil {
+		return nil, err
+	}
+	if c.Config.WorkFactor != 0 {
+		recipient.SetWorkFactor(c.Config.WorkFactor)
+	}
+	if c.Config.KeyVersion == KeyVersionRaw {
+		return []age.Recipient{recipient}, nil
+	}
+	return []age.Recipient{keyedScryptRecipient{
+		epoch:      c.Config.Epoch,
+		keyVersion: c.Config.KeyVersion,
+		recipient:  recipient,
+	}}, nil
+}
+
+// decryptionIdentities returns identities for every key that might have sealed an object. If one of the secret keys
+// unwraps the object, its epoch is stored into matchedEpoch.
+func (c *Clerk) decryptionIdentities(matchedEpoch *int) []age.Identity {
+	var identities []age.Identity
+	if c.identity != nil {
+		identities = append(identities, c.identity)
+	}
+	// the shared key identities are always included, so that objects from devices that derive long-term keys, and
+	// objects from before the roster was adopted, can be read by every device
+	return append(identities,
+		derivedIdentity{clerk: c, matched: matchedEpoch},
+		keyedScryptIdentity{clerk: c, matched: matchedEpoch},
+		rawScryptIdentity{clerk: c, matched: matchedEpoch},
+	)
 }
 
 func (c *Clerk) DeviceName() (string, error) {
 	return c.RemoteClerk.DeviceName()
 }
 
-// HMAC is used by git-annex remote to protect filename infixes.
-func (c *Clerk) HMAC(key string) string {
-	if len(c.Config.SecretKey) == 0 {
-		panic("invalid secret key")
-	}
-	mac := hmac.New(sha3.New256, []byte(c.Config.SecretKey))
+func hmacWithKey(macKey []byte, key string) string {
+	mac := hmac.New(sha3.New256, macKey)
 	mac.Write([]byte(key))
 	return hex.EncodeToString(mac.Sum(nil))
 }
 
+// HMAC is used by git-annex remote to protect filename infixes.
+func (c *Clerk) HMAC(key string) (string, error) {
+	macKey, err := c.Subkey(PurposeInfixMAC)
+	if err != nil {
+		return "", err
+	}
+	return hmacWithKey(macKey, key), nil
+}
+
+// HMACs returns the HMAC of the key under every known epoch and key version, starting with the current ones, so that
+// infixes from before a rekey or key version migration can still be located.
+func (c *Clerk) HMACs(key string) ([]string, error) {
+	var macs []string
+	for _, epochKey := range c.epochKeys() {
+		for _, version := range keyVersionsFrom(c.Config.KeyVersion) {
+			macKey, err := subkey(epochKey.SecretKey, version, PurposeInfixMAC)
+			if err != nil {
+				return nil, err
+			}
+			macs = append(macs, hmacWithKey(macKey, key))
+		}
+	}
+	return macs, nil
+}
+
 func (c *Clerk) ListObjects() ([]string, error) {
 	var contToken *string = nil
 	var paths []string
@@ -127,6 +312,30 @@ type StreamHeader struct {
 	Version int    `json:"version"`
 	Device  string `json:"device"`
 	Infix   string `json:"infix"`
+	Epoch   int    `json:"epoch,omitempty"`
+	// informational, so that objects sealed before a key version migration can be found and re-encrypted
+	KeyVersion int `json:"key-version,omitempty"`
+	// only valid starting with VersionCompressed
+	Compression string `json:"compression,omitempty"`
+	Signed      bool   `json:"signed,omitempty"`
+	// only valid starting with VersionPadded
+	Padding string `json:"padding,omitempty"`
+	// the readable name of an object stored under an opaque infix; only valid starting with VersionNamed
+	Name string `json:"name,omitempty"`
+	// optional metadata, which older clients ignore; see ObjectInfo
+	CreatedMs int64  `json:"created-ms,omitempty"`
+	Length    *int64 `json:"length,omitempty"`
+	Kind      string `json:"kind,omitempty"`
+	AnnexKey  string `json:"annex-key,omitempty"`
+	util.Compatibility
+}
+
+// IsSigned reports whether the object ends with a signature trailer.
+func (h *StreamHeader) IsSigned() bool {
+	if h.Version >= VersionCompressed {
+		return h.Signed
+	}
+	return h.Version >= VersionSigned
 }
 
 func grabHeader(r io.Reader) (*StreamHeader, error) {
@@ -177,82 +386,235 @@ func (c *Clerk) GetDecryptObject(path string) (b []byte, err error) {
 	return data, nil
 }
 
-func (c *Clerk) GetDecryptObjectStream(path string) (rc io.ReadCloser, err error) {
-	device, infix, hash, err := SplitPath(path)
+func (c *Clerk) GetDecryptObjectStream(path string) (io.ReadCloser, error) {
+	_, rc, err := c.GetDecryptObjectStreamWithHeader(path)
+	return rc, err
+}
+
+// checkHeader validates a decrypted header against the path it was downloaded from and the key that unsealed it.
+func (c *Clerk) checkHeader(path string, header *StreamHeader, matchedEpoch int) error {
+	_, infix, _, err := SplitPath(path)
 	if err != nil {
-		return nil, err
+		return err
 	}
-	identity, err := age.NewScryptIdentity(c.Config.SecretKey)
+	device, err := c.PathDevice(path)
 	if err != nil {
-		return nil, err
+		return err
 	}
-	stream, err := c.RemoteClerk.GetObjectStream(path)
+	reader := util.FormatReader{
+		Name:     fmt.Sprintf("object %q", path),
+		Oldest:   VersionPlain,
+		Newest:   Version,
+		Features: objectFeatures,
+	}
+	if err := reader.Check(header.Version, header.Compatibility); err != nil {
+		return err
+	}
+	if header.Device != device {
+		return fmt.Errorf("received data contained device=%q instead of device=%q", header.Device, device)
+	}
+	if header.Infix != infix {
+		return fmt.Errorf("received data contained infix=%q instead of infix=%q", header.Infix, infix)
+	}
+	if IsOpaqueInfix(infix) != (header.Name != "") {
+		return fmt.Errorf("received data for infix=%q contained unexpected name=%q", infix, header.Name)
+	}
+	if header.Name != "" {
+		if header.Version < VersionNamed {
+			return fmt.Errorf("received data contained fields that are not valid in version=%d", header.Version)
+		}
+		candidates, err := c.ObjectInfixes(header.Name)
+		if err != nil {
+			return err
+		}
+		var matched bool
+		for _, candidate := range candidates {
+			matched = matched || candidate == infix
+		}
+		if !matched {
+			return fmt.Errorf("received data contained name=%q that does not match infix=%q", header.Name, infix)
+		}
+	}
+	if matchedEpoch >= 0 && header.Epoch != matchedEpoch {
+		return fmt.Errorf("received data contained epoch=%d but was sealed with the key for epoch=%d",
+			header.Epoch, matchedEpoch)
+	}
+	if header.Version < VersionCompressed && (header.Compression != CompressionNone || header.Signed) {
+		return fmt.Errorf("received data contained fields that are not valid in version=%d", header.Version)
+	}
+	if header.Version < VersionPadded && header.Padding != PaddingNone {
+		return fmt.Errorf("received data contained fields that are not valid in version=%d", header.Version)
+	}
+	if err := validateCompression(header.Compression); err != nil {
+		return err
+	}
+	if err := validatePadding(header.Padding); err != nil {
+		return err
+	}
+	return nil
+}
+
+// GetDecryptObjectStreamWithHeader is like GetDecryptObjectStream, but also returns the authenticated header.
+func (c *Clerk) GetDecryptObjectStreamWithHeader(path string) (h *StreamHeader, rc io.ReadCloser, err error) {
+	if err := c.checkPolicyLoaded(); err != nil {
+		return nil, nil, err
+	}
+	return c.getDecryptObjectStream(path, c.Config.RequireSignatures)
+}
+
+func (c *Clerk) getDecryptObjectStream(
+	path string, requireSignatures bool,
+) (h *StreamHeader, rc io.ReadCloser, err error) {
+	_, _, hash, err := SplitPath(path)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
-	hasher := sha256.New()
-	bufstream, err := BufferInFile(io.TeeReader(stream, hasher))
+	matchedEpoch := -1
+	identities := c.decryptionIdentities(&matchedEpoch)
+	stream, err := c.RemoteClerk.GetObjectStream(path)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 	defer func() {
 		if rc == nil {
-			err = multierror.Append(err, bufstream.Close())
+			err = multierror.Append(err, stream.Close())
 		}
 	}()
-	realHash := hex.EncodeToString(hasher.Sum(nil))
-	if realHash != hash {
-		return nil, fmt.Errorf("hash %q did not match downloaded object %q", realHash, path)
-	}
-	plaintext, err := age.Decrypt(bufstream, identity)
+	// decrypt while downloading; age authenticates every chunk, and the hash is checked once the download ends
+	hasher := sha256.New()
+	ciphertext := io.TeeReader(stream, hasher)
+	decrypted, err := age.Decrypt(ciphertext, identities...)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
+	}
+	plaintext := &hashCheckedReader{
+		plaintext:  decrypted,
+		ciphertext: ciphertext,
+		check: func() error {
+			realHash := hex.EncodeToString(hasher.Sum(nil))
+			if realHash != hash {
+				return fmt.Errorf("hash %q did not match downloaded object %q", realHash, path)
+			}
+			return nil
+		},
 	}
-	header, err := grabHeader(plaintext)
+	digest := sha256.New()
+	header, err := grabHeader(io.TeeReader(plaintext, digest))
 	if err != nil {
-		return nil, err
+		return nil, nil, err
+	}
+	if err := c.checkHeader(path, header, matchedEpoch); err != nil {
+		return nil, nil, err
+	}
+	// checkHeader has matched the device in the header to the path
+	device := header.Device
+	// the hash and any signature are only checked at the end of the object, so nothing can be released until then:
+	// the whole plaintext is buffered (in memory up to memoryBufferLimit, then in a temporary file), not streamed
+	var verified io.ReadSeekCloser
+	var trailer *trailerReader
+	if !header.IsSigned() {
+		// a device that has a verify key always signs, so an unsigned object created since then must have been forged
+		if c.mustBeSigned(header) {
+			return nil, nil, fmt.Errorf("security alert: object %q is not signed by device %q, which has a verify key",
+				path, device)
+		}
+		if requireSignatures {
+			return nil, nil, fmt.Errorf("security alert: object %q is not signed by device %q", path, device)
+		}
+		if c.Roster != nil {
+			_, _ = fmt.Fprintf(os.Stderr, "nightmarket: security alert: accepting unsigned object %q from device %q, "+
+				"which had no verify key when the object claims to have been created\n", path, device)
+		}
+		if verified, err = BufferSpilling(plaintext); err != nil {
+			return nil, nil, err
+		}
+	} else {
+		trailer = newTrailerReader(plaintext, ed25519.SignatureSize)
+		if verified, err = BufferSpilling(io.TeeReader(trailer, digest)); err != nil {
+			return nil, nil, err
+		}
 	}
-	if header.Version != Version {
-		return nil, fmt.Errorf("received data contained version=%d instead of version=%d", header.Version, Version)
+	defer func() {
+		if rc == nil {
+			err = multierror.Append(err, verified.Close())
+		}
+	}()
+	if trailer != nil {
+		signature, err := trailer.Trailer()
+		if err != nil {
+			return nil, nil, err
+		}
+		if err := c.verifyObject(header.Device, digest.Sum(nil), signature); err != nil {
+			return nil, nil, err
+		}
 	}
-	if header.Device != device {
-		return nil, fmt.Errorf("received data contained device=%q instead of device=%q", header.Device, device)
+	var payload io.Reader = verified
+	closers := multiCloser{verified, stream}
+	if header.Padding != PaddingNone {
+		// the length of the padding is only known at the end of the object
+		if payload, err = stripPadding(verified); err != nil {
+			return nil, nil, err
+		}
 	}
-	if header.Infix != infix {
-		return nil, fmt.Errorf("received data contained infix=%q instead of infix=%q", header.Infix, infix)
+	limit := int64(maxUnknownDecompressedSize)
+	if header.Length != nil {
+		limit = *header.Length
+	}
+	decompressed, err := decompressReader(header.Compression, payload, limit)
+	if err != nil {
+		return nil, nil, err
 	}
-	// wrap the plaintext reader with the original
-	return CombinedReadCloser{
-		Reader: plaintext,
-		Closer: bufstream,
+	var result io.Reader = decompressed
+	if header.Length != nil {
+		result = &lengthCheckedReader{r: decompressed, expected: *header.Length}
+	}
+	return header, CombinedReadCloser{
+		Reader: result,
+		Closer: append(multiCloser{decompressed}, closers...),
 	}, nil
 }
 
-func (c *Clerk) PutEncryptObject(pathInfix string, data []byte) (string, error) {
-	return c.PutEncryptObjectStream(pathInfix, bytes.NewReader(data))
+func (c *Clerk) PutEncryptObject(name string, data []byte) (string, error) {
+	return c.PutEncryptObjectStream(name, bytes.NewReader(data))
+}
+
+// PutEncryptObjectStream stores an object with the given name, which is hidden behind an opaque infix if configured.
+func (c *Clerk) PutEncryptObjectStream(name string, data io.Reader) (createdFilename string, err error) {
+	return c.PutEncryptObjectStreamWithInfo(name, data, ObjectInfo{Length: -1})
 }
 
-func (c *Clerk) PutEncryptObjectStream(pathInfix string, data io.Reader) (createdFilename string, err error) {
-	recipient, err := age.NewScryptRecipient(c.Config.SecretKey)
+// PutEncryptObjectStreamWithInfo is like PutEncryptObjectStream, but records additional metadata in the header.
+func (c *Clerk) PutEncryptObjectStreamWithInfo(
+	name string, data io.Reader, info ObjectInfo,
+) (createdFilename string, err error) {
+	if err := c.CheckUpload(name); err != nil {
+		return "", err
+	}
+	pathInfix, err := c.ObjectInfix(name)
 	if err != nil {
 		return "", err
 	}
-	if c.Config.WorkFactor != 0 {
-		recipient.SetWorkFactor(c.Config.WorkFactor)
+	recipients, err := c.encryptionRecipients()
+	// policies are signed by the administrator instead of by the uploading device
+	signingKey := c.signingKey
+	if info.Kind == KindPolicy {
+		// policies are looked up before anything else is loaded, so their names are never hidden, and every holder of
+		// the space key must be able to read them, including devices that they add to the roster
+		pathInfix = name
+		recipients, err = c.sharedRecipients()
+		signingKey = nil
 	}
-	f, err := ioutil.TempFile("", "encrypted-object")
 	if err != nil {
 		return "", err
 	}
+	// the ciphertext is hashed as it is produced, and only spills to disk if it is large
+	buffer := newSpillBuffer()
 	defer func() {
-		if err2 := f.Close(); err2 != nil {
+		if err2 := buffer.Close(); err2 != nil {
 			err = multierror.Append(err, fmt.Errorf("while closing put-encrypt: %w", err2))
 		}
-		if err3 := os.Remove(f.Name()); err3 != nil {
-			err = multierror.Append(err, err3)
-		}
 	}()
-	wc, err := age.Encrypt(f, recipient)
+	wc, err := age.Encrypt(buffer, recipients...)
 	if err != nil {
 		return "", err
 	}
@@ -261,20 +623,75 @@ func (c *Clerk) PutEncryptObjectStream(pathInfix string, data io.Reader) (create
 		return "", err
 	}
 	header := StreamHeader{
-		Version: Version,
-		Device:  device,
-		Infix:   pathInfix,
+		Version:    VersionPlain,
+		Device:     device,
+		Infix:      pathInfix,
+		Epoch:      c.Config.Epoch,
+		KeyVersion: c.Config.KeyVersion,
+		CreatedMs:  time.Now().UnixMilli(),
+		Kind:       info.Kind,
+		AnnexKey:   info.AnnexKey,
+		// older clients ignore this field, so it can be included at every version
+		Compatibility: util.Compatibility{Client: util.ClientVersion},
+	}
+	if info.Length >= 0 {
+		header.Length = &info.Length
+	}
+	if signingKey != nil {
+		header.Version = VersionSigned
+	}
+	header.Compression, data, err = chooseCompression(c.Config.Compression, data)
+	if err != nil {
+		return "", err
+	}
+	if header.Compression != CompressionNone {
+		header.Version = VersionCompressed
+		header.Signed = signingKey != nil
+	}
+	if c.Config.Padding != PaddingNone {
+		header.Version = VersionPadded
+		header.Signed = signingKey != nil
+		header.Padding = c.Config.Padding
 	}
-	if err = writeHeader(wc, header); err != nil {
+	if pathInfix != name {
+		header.Version = VersionNamed
+		header.Signed = signingKey != nil
+		header.Name = name
+	}
+	digest := sha256.New()
+	body := &countingWriter{w: io.MultiWriter(wc, digest)}
+	if err = writeHeader(body, header); err != nil {
 		return "", err
 	}
-	if _, err = io.Copy(wc, data); err != nil {
+	if header.Length != nil {
+		// make sure that the recorded length is accurate, since readers will check it
+		data = &lengthCheckedReader{r: data, expected: *header.Length}
+	}
+	if err = compressInto(header.Compression, body, data); err != nil {
 		return "", err
 	}
+	if header.Padding != PaddingNone {
+		if err = writePadding(body, body.count); err != nil {
+			return "", err
+		}
+	}
+	if header.IsSigned() {
+		signature, err := c.signObject(digest.Sum(nil))
+		if err != nil {
+			return "", err
+		}
+		if _, err = wc.Write(signature); err != nil {
+			return "", err
+		}
+	}
 	if err = wc.Close(); err != nil {
 		return "", err
 	}
-	createdFilename, err = c.RemoteClerk.PutObjectStream(pathInfix, f)
+	contents, err := buffer.Contents()
+	if err != nil {
+		return "", err
+	}
+	createdFilename, err = c.RemoteClerk.PutObjectHashed(pathInfix, buffer.Sum(), buffer.Len(), contents)
 	if err != nil {
 		return "", err
 	}
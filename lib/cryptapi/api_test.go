@@ -0,0 +1,30 @@
+package cryptapi
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/celskeggs/nightmarket/lib/util"
+)
+
+func TestCheckHeaderFeatures(t *testing.T) {
+	c := &Clerk{Config: ClerkConfig{SecretKey: "secret"}}
+	header := &StreamHeader{
+		Version:       VersionFeatures,
+		Device:        "A",
+		Infix:         "push-0-0",
+		Compatibility: util.Compatibility{Optional: []string{"unknown-extension"}},
+	}
+	if err := c.checkHeader("A/push-0-0#hash", header, -1); err != nil {
+		t.Errorf("object with an unknown optional feature was rejected: %v", err)
+	}
+	header.Required = []string{"unknown-feature"}
+	err := c.checkHeader("A/push-0-0#hash", header, -1)
+	if err == nil || !strings.Contains(err.Error(), "unknown-feature") {
+		t.Errorf("object with an unknown required feature was not rejected: %v", err)
+	}
+	header.Required, header.MinVersion, header.Version = nil, Version+1, Version+2
+	if err := c.checkHeader("A/push-0-0#hash", header, -1); err == nil {
+		t.Error("object needing a newer reader was not rejected")
+	}
+}
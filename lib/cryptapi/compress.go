@@ -0,0 +1,111 @@
+package cryptapi
+
+import (
+	"bytes"
+	"compress/flate"
+	"errors"
+	"fmt"
+	"io"
+)
+
+const (
+	CompressionNone    = ""
+	CompressionDeflate = "deflate"
+)
+
+// how much of an object to sample when deciding whether compression is worthwhile
+const compressionSampleSize = 64 * 1024
+
+// compression is skipped unless the sample shrinks to at most this fraction of its size
+const compressionMaxRatio = 0.9
+
+// the most that a compressed object may expand to when its header does not record its length, so that a small object
+// cannot fill the disk (objects without a recorded length are git packs, which rarely compress in the first place)
+const maxUnknownDecompressedSize = 4 << 30
+
+func validateCompression(compression string) error {
+	if compression != CompressionNone && compression != CompressionDeflate {
+		return fmt.Errorf("unsupported compression %q", compression)
+	}
+	return nil
+}
+
+// chooseCompression samples the start of the data to decide whether it compresses, and returns a reader that still
+// produces the complete data.
+func chooseCompression(configured string, data io.Reader) (string, io.Reader, error) {
+	if configured == CompressionNone {
+		return CompressionNone, data, nil
+	}
+	sample := make([]byte, compressionSampleSize)
+	n, err := io.ReadFull(data, sample)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return "", nil, err
+	}
+	sample = sample[:n]
+	data = io.MultiReader(bytes.NewReader(sample), data)
+	if n == 0 {
+		return CompressionNone, data, nil
+	}
+	var compressed bytes.Buffer
+	if err := compressInto(configured, &compressed, bytes.NewReader(sample)); err != nil {
+		return "", nil, err
+	}
+	if float64(compressed.Len()) > float64(n)*compressionMaxRatio {
+		// probably already compressed or encrypted, so don't waste the effort
+		return CompressionNone, data, nil
+	}
+	return configured, data, nil
+}
+
+func compressInto(compression string, w io.Writer, data io.Reader) error {
+	switch compression {
+	case CompressionNone:
+		_, err := io.Copy(w, data)
+		return err
+	case CompressionDeflate:
+		fw, err := flate.NewWriter(w, flate.DefaultCompression)
+		if err != nil {
+			return err
+		}
+		if _, err := io.Copy(fw, data); err != nil {
+			return err
+		}
+		return fw.Close()
+	default:
+		return fmt.Errorf("unsupported compression %q", compression)
+	}
+}
+
+// decompressReader undoes compression, and fails rather than producing more than limit bytes.
+func decompressReader(compression string, r io.Reader, limit int64) (io.ReadCloser, error) {
+	switch compression {
+	case CompressionNone:
+		return io.NopCloser(r), nil
+	case CompressionDeflate:
+		fr := flate.NewReader(r)
+		return CombinedReadCloser{
+			Reader: &boundedReader{r: fr, remaining: limit},
+			Closer: fr,
+		}, nil
+	default:
+		return nil, fmt.Errorf("unsupported compression %q", compression)
+	}
+}
+
+// boundedReader fails once the underlying reader produces more than the permitted number of bytes.
+type boundedReader struct {
+	r         io.Reader
+	remaining int64
+}
+
+func (b *boundedReader) Read(p []byte) (int, error) {
+	if int64(len(p)) > b.remaining+1 {
+		p = p[:b.remaining+1]
+	}
+	n, err := b.r.Read(p)
+	if int64(n) > b.remaining {
+		return 0, errors.New("decompressed object exceeded its size limit")
+	}
+	b.remaining -= int64(n)
+	return n, err
+}
@@ -0,0 +1,37 @@
+package cryptapi
+
+import (
+	"bytes"
+	"io"
+	"testing"
+)
+
+func TestDecompressionLimit(t *testing.T) {
+	data := make([]byte, 1<<20)
+	var compressed bytes.Buffer
+	if err := compressInto(CompressionDeflate, &compressed, bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	if compressed.Len() > len(data)/100 {
+		t.Fatalf("zeros only compressed to %d bytes", compressed.Len())
+	}
+	r, err := decompressReader(CompressionDeflate, bytes.NewReader(compressed.Bytes()), int64(len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatalf("object at its size limit was rejected: %v", err)
+	}
+	if !bytes.Equal(result, data) {
+		t.Error("decompressed data does not match")
+	}
+	// a small object must not be able to expand beyond what its header claims
+	r, err = decompressReader(CompressionDeflate, bytes.NewReader(compressed.Bytes()), int64(len(data))-1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadAll(r); err == nil {
+		t.Error("object that expanded beyond its size limit was accepted")
+	}
+}
@@ -0,0 +1,180 @@
+package cryptapi
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+
+	"filippo.io/age"
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/scrypt"
+)
+
+// derived stanza types mark objects sealed to a long-term X25519 key derived from a secret key, one type per key
+// version. The stanza records the epoch, work factor, and salt used for the derivation, so that any device that knows
+// the secret key can repeat it.
+var derivedStanzaTypes = map[int]string{
+	KeyVersionRaw:     "nightmarket-derived",
+	KeyVersionSubkeys: "nightmarket-derived-subkey",
+}
+
+const derivedSaltPrefix = "nightmarket-derived-key-v1\x00"
+
+// the same default as age uses for its own scrypt recipients
+const defaultWorkFactor = 18
+
+// the same limit as age places on its own scrypt identities
+const maxWorkFactor = 22
+
+type derivation struct {
+	keyVersion int
+	epoch      int
+	workFactor int
+	salt       string
+}
+
+// derivedKeys caches derived identities, so that scrypt only needs to run once per derivation.
+type derivedKeys struct {
+	mu         sync.Mutex
+	identities map[derivation]*age.X25519Identity
+}
+
+func deriveIdentity(secretKey string, workFactor int, salt []byte) (*age.X25519Identity, error) {
+	scalar, err := scrypt.Key([]byte(secretKey), append([]byte(derivedSaltPrefix), salt...),
+		1<<workFactor, 8, 1, curve25519.ScalarSize)
+	if err != nil {
+		return nil, err
+	}
+	encoded, err := bech32Encode("age-secret-key-", scalar)
+	if err != nil {
+		return nil, err
+	}
+	return age.ParseX25519Identity(strings.ToUpper(encoded))
+}
+
+func (c *Clerk) derivedIdentity(d derivation) (*age.X25519Identity, error) {
+	secretKey, found := c.epochSecretKey(d.epoch)
+	if !found {
+		return nil, fmt.Errorf("no secret key known for epoch %d", d.epoch)
+	}
+	c.derived.mu.Lock()
+	defer c.derived.mu.Unlock()
+	if identity, found := c.derived.identities[d]; found {
+		return identity, nil
+	}
+	pass, err := passphrase(secretKey, d.keyVersion)
+	if err != nil {
+		return nil, err
+	}
+	identity, err := deriveIdentity(pass, d.workFactor, []byte(d.salt))
+	if err != nil {
+		return nil, err
+	}
+	if c.derived.identities == nil {
+		c.derived.identities = map[derivation]*age.X25519Identity{}
+	}
+	c.derived.identities[d] = identity
+	return identity, nil
+}
+
+// currentDerivation is the derivation that this device uses when encrypting. The salt is specific to the space but
+// shared by its devices, so that a reader only requires one derivation per epoch to read objects from every device.
+// (objects from before the salt was shared record per-device salts, which are still derived when they are read.)
+func (c *Clerk) currentDerivation() derivation {
+	workFactor := c.Config.WorkFactor
+	if workFactor == 0 {
+		workFactor = defaultWorkFactor
+	}
+	return derivation{
+		keyVersion: c.Config.KeyVersion,
+		epoch:      c.Config.Epoch,
+		workFactor: workFactor,
+		salt:       c.Config.SpaceConfig.SpacePrefix,
+	}
+}
+
+type derivedRecipient struct {
+	derivation derivation
+	recipient  *age.X25519Recipient
+}
+
+func (r derivedRecipient) Wrap(fileKey []byte) ([]*age.Stanza, error) {
+	stanzas, err := r.recipient.Wrap(fileKey)
+	if err != nil {
+		return nil, err
+	}
+	if len(stanzas) != 1 {
+		return nil, errors.New("internal error: expected exactly one X25519 stanza")
+	}
+	args := []string{
+		strconv.Itoa(r.derivation.epoch),
+		strconv.Itoa(r.derivation.workFactor),
+		base64.RawStdEncoding.EncodeToString([]byte(r.derivation.salt)),
+	}
+	return []*age.Stanza{{
+		Type: derivedStanzaTypes[r.derivation.keyVersion],
+		Args: append(args, stanzas[0].Args...),
+		Body: stanzas[0].Body,
+	}}, nil
+}
+
+// derivedIdentity unwraps derived stanzas, running scrypt only the first time each derivation is encountered.
+type derivedIdentity struct {
+	clerk   *Clerk
+	matched *int
+}
+
+func parseDerivedStanza(keyVersion int, s *age.Stanza) (derivation, *age.Stanza, error) {
+	if len(s.Args) != 4 {
+		return derivation{}, nil, errors.New("invalid derived stanza")
+	}
+	epoch, err := strconv.Atoi(s.Args[0])
+	if err != nil || epoch < 0 {
+		return derivation{}, nil, errors.New("invalid derived stanza epoch")
+	}
+	workFactor, err := strconv.Atoi(s.Args[1])
+	if err != nil || workFactor < 1 || workFactor > maxWorkFactor {
+		return derivation{}, nil, errors.New("invalid derived stanza work factor")
+	}
+	salt, err := base64.RawStdEncoding.Strict().DecodeString(s.Args[2])
+	if err != nil {
+		return derivation{}, nil, errors.New("invalid derived stanza salt")
+	}
+	inner := &age.Stanza{Type: "X25519", Args: s.Args[3:], Body: s.Body}
+	return derivation{keyVersion: keyVersion, epoch: epoch, workFactor: workFactor, salt: string(salt)}, inner, nil
+}
+
+func (i derivedIdentity) Unwrap(stanzas []*age.Stanza) ([]byte, error) {
+	for _, s := range stanzas {
+		keyVersion := -1
+		for version, stanzaType := range derivedStanzaTypes {
+			if s.Type == stanzaType {
+				keyVersion = version
+			}
+		}
+		if keyVersion < 0 {
+			continue
+		}
+		d, inner, err := parseDerivedStanza(keyVersion, s)
+		if err != nil {
+			return nil, err
+		}
+		identity, err := i.clerk.derivedIdentity(d)
+		if err != nil {
+			// sealed under an epoch that we don't know about
+			continue
+		}
+		fileKey, err := identity.Unwrap([]*age.Stanza{inner})
+		if err == nil {
+			*i.matched = d.epoch
+			return fileKey, nil
+		}
+		if !errors.Is(err, age.ErrIncorrectIdentity) {
+			return nil, err
+		}
+	}
+	return nil, age.ErrIncorrectIdentity
+}
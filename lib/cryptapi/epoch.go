@@ -0,0 +1,191 @@
+package cryptapi
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+
+	"filippo.io/age"
+)
+
+type void struct{}
+
+// KeyEpoch is a retired secret key, kept so that objects sealed before the most recent rekey remain readable.
+type KeyEpoch struct {
+	Epoch     int    `json:"epoch"`
+	SecretKey string `json:"secret-key"`
+}
+
+func validateKeyring(config ClerkConfig) error {
+	if config.Epoch < 0 {
+		return errors.New("invalid key epoch")
+	}
+	seen := map[int]void{}
+	for _, old := range config.Keyring {
+		if len(old.SecretKey) == 0 {
+			return fmt.Errorf("invalid secret key for epoch %d: length is 0", old.Epoch)
+		}
+		if old.Epoch < 0 || old.Epoch >= config.Epoch {
+			return fmt.Errorf("keyring epoch %d is not older than current epoch %d", old.Epoch, config.Epoch)
+		}
+		if _, found := seen[old.Epoch]; found {
+			return fmt.Errorf("duplicate keyring epoch %d", old.Epoch)
+		}
+		seen[old.Epoch] = void{}
+	}
+	return nil
+}
+
+// epochKeys returns every known secret key, starting with the current key and then from newest to oldest.
+func (c *Clerk) epochKeys() []KeyEpoch {
+	keys := []KeyEpoch{{Epoch: c.Config.Epoch, SecretKey: c.Config.SecretKey}}
+	older := append([]KeyEpoch(nil), c.Config.Keyring...)
+	sort.Slice(older, func(i, j int) bool {
+		return older[i].Epoch > older[j].Epoch
+	})
+	return append(keys, older...)
+}
+
+// epochSecretKey returns the secret key of the given epoch, if it is known.
+func (c *Clerk) epochSecretKey(epoch int) (string, bool) {
+	for _, key := range c.epochKeys() {
+		if key.Epoch == epoch {
+			return key.SecretKey, true
+		}
+	}
+	return "", false
+}
+
+// keyed scrypt stanza types mark objects sealed to the passphrase of a particular epoch, one type per key version. The
+// stanza records the epoch, so that readers only need to run scrypt with that epoch's key. Objects sealed under the
+// raw key version keep using age's own scrypt stanza, so that they remain readable by older versions.
+var keyedScryptStanzaTypes = map[int]string{
+	KeyVersionSubkeys: "nightmarket-scrypt-subkey",
+}
+
+type keyedScryptRecipient struct {
+	epoch      int
+	keyVersion int
+	recipient  *age.ScryptRecipient
+}
+
+func (r keyedScryptRecipient) Wrap(fileKey []byte) ([]*age.Stanza, error) {
+	stanzas, err := r.recipient.Wrap(fileKey)
+	if err != nil {
+		return nil, err
+	}
+	if len(stanzas) != 1 {
+		return nil, errors.New("internal error: expected exactly one scrypt stanza")
+	}
+	return []*age.Stanza{{
+		Type: keyedScryptStanzaTypes[r.keyVersion],
+		Args: append([]string{strconv.Itoa(r.epoch)}, stanzas[0].Args...),
+		Body: stanzas[0].Body,
+	}}, nil
+}
+
+// keyedScryptIdentity unwraps keyed scrypt stanzas, using only the key of the epoch that the stanza names.
+type keyedScryptIdentity struct {
+	clerk   *Clerk
+	matched *int
+}
+
+func (i keyedScryptIdentity) Unwrap(stanzas []*age.Stanza) ([]byte, error) {
+	for _, s := range stanzas {
+		keyVersion := -1
+		for version, stanzaType := range keyedScryptStanzaTypes {
+			if s.Type == stanzaType {
+				keyVersion = version
+			}
+		}
+		if keyVersion < 0 {
+			continue
+		}
+		// like age's own scrypt stanzas, these must not be mixed with any other recipients
+		if len(stanzas) != 1 {
+			return nil, errors.New("keyed scrypt stanza is not the only stanza")
+		}
+		if len(s.Args) < 1 {
+			return nil, errors.New("invalid keyed scrypt stanza")
+		}
+		epoch, err := strconv.Atoi(s.Args[0])
+		if err != nil || epoch < 0 {
+			return nil, errors.New("invalid keyed scrypt stanza epoch")
+		}
+		secretKey, found := i.clerk.epochSecretKey(epoch)
+		if !found {
+			// sealed under an epoch that we don't know about
+			return nil, age.ErrIncorrectIdentity
+		}
+		pass, err := passphrase(secretKey, keyVersion)
+		if err != nil {
+			return nil, err
+		}
+		identity, err := age.NewScryptIdentity(pass)
+		if err != nil {
+			return nil, err
+		}
+		fileKey, err := identity.Unwrap([]*age.Stanza{{Type: "scrypt", Args: s.Args[1:], Body: s.Body}})
+		if err == nil {
+			*i.matched = epoch
+		}
+		return fileKey, err
+	}
+	return nil, age.ErrIncorrectIdentity
+}
+
+// rawScryptIdentity unwraps age's own scrypt stanzas, which are only used under the raw key version. These stanzas do
+// not record an epoch, so each known key is tried in turn, starting with the current one.
+type rawScryptIdentity struct {
+	clerk   *Clerk
+	matched *int
+}
+
+func (i rawScryptIdentity) Unwrap(stanzas []*age.Stanza) ([]byte, error) {
+	if len(stanzas) != 1 || stanzas[0].Type != "scrypt" {
+		return nil, age.ErrIncorrectIdentity
+	}
+	for _, key := range i.clerk.epochKeys() {
+		pass, err := passphrase(key.SecretKey, KeyVersionRaw)
+		if err != nil {
+			return nil, err
+		}
+		identity, err := age.NewScryptIdentity(pass)
+		if err != nil {
+			return nil, err
+		}
+		fileKey, err := identity.Unwrap(stanzas)
+		if err == nil {
+			*i.matched = key.Epoch
+			return fileKey, nil
+		}
+		if !errors.Is(err, age.ErrIncorrectIdentity) {
+			return nil, err
+		}
+	}
+	return nil, age.ErrIncorrectIdentity
+}
+
+// RotateKey makes newSecretKey the current key of the configuration, retiring the previous key into the keyring.
+func RotateKey(config ClerkConfig, newSecretKey string) (ClerkConfig, error) {
+	if len(newSecretKey) == 0 {
+		return ClerkConfig{}, errors.New("invalid secret key: length is 0")
+	}
+	if config.SecretKeySource != nil {
+		// the old key would have to be retired into the keyring, but it is not part of the configuration
+		return ClerkConfig{}, errors.New("cannot rotate a secret key that is supplied by a secret source")
+	}
+	for _, old := range append(config.Keyring, KeyEpoch{SecretKey: config.SecretKey}) {
+		if old.SecretKey == newSecretKey {
+			return ClerkConfig{}, errors.New("new secret key was already used in a previous epoch")
+		}
+	}
+	config.Keyring = append(append([]KeyEpoch(nil), config.Keyring...), KeyEpoch{
+		Epoch:     config.Epoch,
+		SecretKey: config.SecretKey,
+	})
+	config.Epoch++
+	config.SecretKey = newSecretKey
+	return config, nil
+}
@@ -0,0 +1,280 @@
+package cryptapi
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"filippo.io/age"
+	"filippo.io/age/armor"
+	"github.com/celskeggs/nightmarket/lib/util"
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+const escrowVersion = 1
+
+const escrowDomain = "nightmarket-escrow-v1\x00"
+
+// EscrowSecret is the part of a configuration that is needed to read every object in the space.
+type EscrowSecret struct {
+	SecretKey  string     `json:"secret-key"`
+	Epoch      int        `json:"epoch,omitempty"`
+	Keyring    []KeyEpoch `json:"keyring,omitempty"`
+	KeyVersion int        `json:"key-version,omitempty"`
+}
+
+func EscrowSecretOf(config ClerkConfig) EscrowSecret {
+	return EscrowSecret{
+		SecretKey:  config.SecretKey,
+		Epoch:      config.Epoch,
+		Keyring:    config.Keyring,
+		KeyVersion: config.KeyVersion,
+	}
+}
+
+// Install replaces the keys of a configuration with the escrowed keys.
+func (e EscrowSecret) Install(config ClerkConfig) ClerkConfig {
+	config.SecretKey = e.SecretKey
+	config.Epoch = e.Epoch
+	config.Keyring = e.Keyring
+	config.KeyVersion = e.KeyVersion
+	return config
+}
+
+// EscrowShare is one of the shares produced by SplitEscrow. Threshold shares from the same set are needed to recover
+// the secret; fewer reveal nothing about it.
+//
+// The secret itself is encrypted under a random key, which is what is split, and the ciphertext is included in every
+// share. Every share also lists checksums of all the shares in its set, so that corrupted or substituted shares are
+// identified before the secret is reconstructed.
+type EscrowShare struct {
+	Version int    `json:"version"`
+	Set     string `json:"set"`
+	Label   string `json:"label"`
+	// the x coordinate of this share, from 1 through the number of shares
+	Index     int      `json:"index"`
+	Threshold int      `json:"threshold"`
+	Value     []byte   `json:"value"`
+	Checksums []string `json:"checksums"`
+	Sealed    []byte   `json:"sealed"`
+	util.Compatibility
+}
+
+func escrowChecksum(set string, index int, value []byte) string {
+	h := sha256.New()
+	h.Write([]byte(escrowDomain))
+	h.Write([]byte(set))
+	h.Write([]byte{0, byte(index)})
+	h.Write(value)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// SplitEscrow splits secret into one share per label, any threshold of which can recover it.
+func SplitEscrow(secret EscrowSecret, threshold int, labels []string) ([]EscrowShare, error) {
+	if secret.SecretKey == "" {
+		return nil, errors.New("invalid secret key: length is 0")
+	}
+	plaintext, err := json.Marshal(secret)
+	if err != nil {
+		return nil, err
+	}
+	setBytes := make([]byte, 16)
+	if _, err := rand.Read(setBytes); err != nil {
+		return nil, err
+	}
+	set := hex.EncodeToString(setBytes)
+	key := make([]byte, chacha20poly1305.KeySize)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	aead, err := chacha20poly1305.NewX(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	sealed := aead.Seal(nonce, nonce, plaintext, []byte(escrowDomain+set))
+	values, err := shamirSplit(key, threshold, len(labels))
+	if err != nil {
+		return nil, err
+	}
+	var checksums []string
+	for i, value := range values {
+		checksums = append(checksums, escrowChecksum(set, i+1, value))
+	}
+	var shares []EscrowShare
+	for i, value := range values {
+		shares = append(shares, EscrowShare{
+			Version:       escrowVersion,
+			Set:           set,
+			Label:         labels[i],
+			Index:         i + 1,
+			Threshold:     threshold,
+			Value:         value,
+			Checksums:     checksums,
+			Sealed:        sealed,
+			Compatibility: util.Compatibility{Client: util.ClientVersion},
+		})
+	}
+	return shares, nil
+}
+
+// Verify checks that a share is internally consistent.
+func (s EscrowShare) Verify() error {
+	reader := util.FormatReader{
+		Name:   fmt.Sprintf("escrow share %q", s.Label),
+		Oldest: escrowVersion,
+		Newest: escrowVersion,
+	}
+	if err := reader.Check(s.Version, s.Compatibility); err != nil {
+		return err
+	}
+	if s.Threshold < 2 || s.Threshold > len(s.Checksums) || s.Index < 1 || s.Index > len(s.Checksums) {
+		return fmt.Errorf("escrow share %q is malformed", s.Label)
+	}
+	if escrowChecksum(s.Set, s.Index, s.Value) != s.Checksums[s.Index-1] {
+		return fmt.Errorf("escrow share %q does not match its checksum: it is corrupted", s.Label)
+	}
+	return nil
+}
+
+// CombineEscrow recovers the secret from at least a threshold of shares from the same set.
+func CombineEscrow(shares []EscrowShare) (EscrowSecret, error) {
+	if len(shares) == 0 {
+		return EscrowSecret{}, errors.New("no escrow shares provided")
+	}
+	first := shares[0]
+	var xs []byte
+	var values [][]byte
+	for _, share := range shares {
+		if err := share.Verify(); err != nil {
+			return EscrowSecret{}, err
+		}
+		if share.Set != first.Set {
+			return EscrowSecret{}, fmt.Errorf("escrow shares %q and %q are from different splits",
+				first.Label, share.Label)
+		}
+		// every share vouches for the checksums of the others, so a share that was altered (even consistently with
+		// its own checksum) disagrees with the rest of the set
+		if share.Threshold != first.Threshold || !bytes.Equal(share.Sealed, first.Sealed) ||
+			strings.Join(share.Checksums, ",") != strings.Join(first.Checksums, ",") {
+			return EscrowSecret{}, fmt.Errorf("escrow shares %q and %q disagree about their set: one has been "+
+				"altered", first.Label, share.Label)
+		}
+		for _, x := range xs {
+			if int(x) == share.Index {
+				return EscrowSecret{}, fmt.Errorf("escrow share %q was provided more than once", share.Label)
+			}
+		}
+		xs = append(xs, byte(share.Index))
+		values = append(values, share.Value)
+	}
+	if len(shares) < first.Threshold {
+		return EscrowSecret{}, fmt.Errorf("%d escrow shares are needed, but only %d were provided",
+			first.Threshold, len(shares))
+	}
+	key, err := shamirCombine(xs, values)
+	if err != nil {
+		return EscrowSecret{}, err
+	}
+	aead, err := chacha20poly1305.NewX(key)
+	if err != nil {
+		return EscrowSecret{}, err
+	}
+	if len(first.Sealed) < aead.NonceSize() {
+		return EscrowSecret{}, errors.New("escrowed secret is truncated")
+	}
+	nonce, ciphertext := first.Sealed[:aead.NonceSize()], first.Sealed[aead.NonceSize():]
+	plaintext, err := aead.Open(nil, nonce, ciphertext, []byte(escrowDomain+first.Set))
+	if err != nil {
+		return EscrowSecret{}, errors.New("escrow shares did not reconstruct the escrowed secret")
+	}
+	var secret EscrowSecret
+	if err := json.Unmarshal(plaintext, &secret); err != nil {
+		return EscrowSecret{}, err
+	}
+	return secret, nil
+}
+
+// SealShare encrypts a share for its holder, either to an age recipient ("age1...") or with a passphrase.
+func SealShare(share EscrowShare, recipientOrPassphrase string) ([]byte, error) {
+	var recipient age.Recipient
+	if strings.HasPrefix(recipientOrPassphrase, "age1") {
+		x25519, err := age.ParseX25519Recipient(recipientOrPassphrase)
+		if err != nil {
+			return nil, err
+		}
+		recipient = x25519
+	} else if recipientOrPassphrase != "" {
+		scrypt, err := age.NewScryptRecipient(recipientOrPassphrase)
+		if err != nil {
+			return nil, err
+		}
+		recipient = scrypt
+	} else {
+		return nil, errors.New("an escrow share must be encrypted to a recipient or a passphrase")
+	}
+	plaintext, err := json.Marshal(share)
+	if err != nil {
+		return nil, err
+	}
+	var out bytes.Buffer
+	armored := armor.NewWriter(&out)
+	w, err := age.Encrypt(armored, recipient)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(plaintext); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	if err := armored.Close(); err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
+
+// OpenShare decrypts and verifies a share, using either an age identity ("AGE-SECRET-KEY-1...") or a passphrase.
+func OpenShare(data []byte, identityOrPassphrase string) (EscrowShare, error) {
+	var identity age.Identity
+	if strings.HasPrefix(identityOrPassphrase, "AGE-SECRET-KEY-1") {
+		x25519, err := age.ParseX25519Identity(identityOrPassphrase)
+		if err != nil {
+			return EscrowShare{}, err
+		}
+		identity = x25519
+	} else {
+		scrypt, err := age.NewScryptIdentity(identityOrPassphrase)
+		if err != nil {
+			return EscrowShare{}, err
+		}
+		identity = scrypt
+	}
+	r, err := age.Decrypt(armor.NewReader(bufio.NewReader(bytes.NewReader(data))), identity)
+	if err != nil {
+		return EscrowShare{}, err
+	}
+	plaintext, err := io.ReadAll(r)
+	if err != nil {
+		return EscrowShare{}, err
+	}
+	var share EscrowShare
+	if err := json.Unmarshal(plaintext, &share); err != nil {
+		return EscrowShare{}, err
+	}
+	if err := share.Verify(); err != nil {
+		return EscrowShare{}, err
+	}
+	return share, nil
+}
@@ -0,0 +1,71 @@
+package cryptapi
+
+import (
+	"fmt"
+	"io"
+
+	"filippo.io/age"
+	"github.com/hashicorp/go-multierror"
+)
+
+const (
+	KindGitPack = "git-pack"
+	KindAnnex   = "annex"
+	KindPolicy  = "policy"
+)
+
+// ObjectInfo is optional metadata recorded in the authenticated header of a new object.
+type ObjectInfo struct {
+	Kind     string
+	AnnexKey string
+	// the length of the data, or -1 if it is not known in advance
+	Length int64
+}
+
+// enough to cover the age header and the first chunk of the payload, which contains the StreamHeader
+const inspectRangeSize = 256 * 1024
+
+// InspectObject decrypts only the header of an object, downloading as little of the object as possible. Because the
+// rest of the object is not downloaded, neither its hash nor its signature can be checked. If the header was decrypted
+// but is not valid, it is returned along with the error.
+func (c *Clerk) InspectObject(path string) (h *StreamHeader, err error) {
+	if err := c.checkPolicyLoaded(); err != nil {
+		return nil, err
+	}
+	matchedEpoch := -1
+	identities := c.decryptionIdentities(&matchedEpoch)
+	stream, err := c.RemoteClerk.GetObjectRange(path, inspectRangeSize)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err2 := stream.Close(); err2 != nil {
+			err = multierror.Append(err, err2)
+		}
+	}()
+	decrypted, err := age.Decrypt(stream, identities...)
+	if err != nil {
+		return nil, err
+	}
+	header, err := grabHeader(decrypted)
+	if err != nil {
+		return nil, err
+	}
+	return header, c.checkHeader(path, header, matchedEpoch)
+}
+
+// lengthCheckedReader reports an error instead of EOF if the data did not have the length recorded in its header.
+type lengthCheckedReader struct {
+	r        io.Reader
+	expected int64
+	actual   int64
+}
+
+func (l *lengthCheckedReader) Read(p []byte) (int, error) {
+	n, err := l.r.Read(p)
+	l.actual += int64(n)
+	if err == io.EOF && l.actual != l.expected {
+		return n, fmt.Errorf("object contained %d bytes instead of the %d bytes in its header", l.actual, l.expected)
+	}
+	return n, err
+}
@@ -0,0 +1,233 @@
+package cryptapi
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base32"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// opaque infixes replace the readable name of an object (such as "push-3-7") with a token, so that the storage
+// provider cannot see what kind of object it is or how many pushes a device has made. The readable name is recorded in
+// the authenticated header as well.
+//
+// new objects use sealed infixes, which encrypt the name so that readers can recover it without downloading anything.
+// objects from before sealed infixes use a keyed hash instead, and their names can only be learned from their headers.
+const (
+	opaquePrefix = "o-"
+	sealedPrefix = "s-"
+)
+
+// device aliases replace the name of a device in its object paths with a sealed token. The watchdemon server only ever
+// sees the alias, since the device is registered with it under that alias.
+const aliasPrefix = "d-"
+
+// the fixed lengths that sealed strings are padded to, so that their tokens do not reveal their lengths. names must
+// fit "upload-" and a hex HMAC, and the resulting path segments must stay within the 255 bytes that filesystem-backed
+// stores allow.
+const (
+	sealedNameSize  = 72
+	sealedAliasSize = 64
+)
+
+// lowercase base32 keeps tokens shorter than hex while remaining safe in object keys
+var tokenEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+const sealIVSize = 16
+
+// purposes for subkeys; see subkey
+const (
+	PurposeObjectName       = "object-name"
+	PurposeSealedNameMAC    = "sealed-name-mac"
+	PurposeSealedNameCipher = "sealed-name-encryption"
+	PurposeAliasMAC         = "device-alias-mac"
+	PurposeAliasCipher      = "device-alias-encryption"
+)
+
+func IsOpaqueInfix(infix string) bool {
+	return strings.HasPrefix(infix, opaquePrefix) || IsSealedInfix(infix)
+}
+
+// IsSealedInfix reports whether the name behind an opaque infix can be recovered without downloading the object.
+func IsSealedInfix(infix string) bool {
+	return strings.HasPrefix(infix, sealedPrefix)
+}
+
+func isDeviceAlias(directory string) bool {
+	return strings.HasPrefix(directory, aliasPrefix)
+}
+
+// sealToken encrypts a string deterministically, so that the same string always produces the same token and can be
+// looked up by it. The IV is a keyed hash of the padded plaintext, which opening checks (the SIV construction).
+func sealToken(secretKey, macPurpose, cipherPurpose, plaintext string, size int) (string, error) {
+	if len(plaintext) > size || strings.IndexByte(plaintext, 0) != -1 {
+		return "", fmt.Errorf("cannot seal %q: must be at most %d bytes and contain no NUL bytes", plaintext, size)
+	}
+	macKey, err := subkey(secretKey, KeyVersionSubkeys, macPurpose)
+	if err != nil {
+		return "", err
+	}
+	cipherKey, err := subkey(secretKey, KeyVersionSubkeys, cipherPurpose)
+	if err != nil {
+		return "", err
+	}
+	padded := make([]byte, size)
+	copy(padded, plaintext)
+	mac := hmac.New(sha256.New, macKey)
+	mac.Write(padded)
+	iv := mac.Sum(nil)[:sealIVSize]
+	block, err := aes.NewCipher(cipherKey)
+	if err != nil {
+		return "", err
+	}
+	sealed := make([]byte, sealIVSize+size)
+	copy(sealed, iv)
+	cipher.NewCTR(block, iv).XORKeyStream(sealed[sealIVSize:], padded)
+	return strings.ToLower(tokenEncoding.EncodeToString(sealed)), nil
+}
+
+// openToken reverses sealToken, reporting false if the token was not sealed with this key.
+func openToken(secretKey, macPurpose, cipherPurpose, token string, size int) (string, bool, error) {
+	sealed, err := tokenEncoding.DecodeString(strings.ToUpper(token))
+	if err != nil || len(sealed) != sealIVSize+size {
+		return "", false, fmt.Errorf("invalid sealed token %q", token)
+	}
+	macKey, err := subkey(secretKey, KeyVersionSubkeys, macPurpose)
+	if err != nil {
+		return "", false, err
+	}
+	cipherKey, err := subkey(secretKey, KeyVersionSubkeys, cipherPurpose)
+	if err != nil {
+		return "", false, err
+	}
+	block, err := aes.NewCipher(cipherKey)
+	if err != nil {
+		return "", false, err
+	}
+	iv, padded := sealed[:sealIVSize], make([]byte, size)
+	cipher.NewCTR(block, iv).XORKeyStream(padded, sealed[sealIVSize:])
+	mac := hmac.New(sha256.New, macKey)
+	mac.Write(padded)
+	if !hmac.Equal(mac.Sum(nil)[:sealIVSize], iv) {
+		return "", false, nil
+	}
+	return string(bytes.TrimRight(padded, "\x00")), true, nil
+}
+
+func opaqueInfix(secretKey string, name string) (string, error) {
+	// opaque names postdate the raw key version, so they always use a subkey
+	macKey, err := subkey(secretKey, KeyVersionSubkeys, PurposeObjectName)
+	if err != nil {
+		return "", err
+	}
+	return opaquePrefix + hmacWithKey(macKey, name), nil
+}
+
+func sealedInfix(secretKey string, name string) (string, error) {
+	token, err := sealToken(secretKey, PurposeSealedNameMAC, PurposeSealedNameCipher, name, sealedNameSize)
+	if err != nil {
+		return "", err
+	}
+	return sealedPrefix + token, nil
+}
+
+// ObjectInfix returns the infix that a new object with the given name should be stored under.
+func (c *Clerk) ObjectInfix(name string) (string, error) {
+	if c.Config.OpaqueNames {
+		return sealedInfix(c.Config.SecretKey, name)
+	}
+	return name, nil
+}
+
+// ObjectInfixes returns every infix that an object with the given name might have been stored under, starting with
+// the infix that ObjectInfix would produce.
+func (c *Clerk) ObjectInfixes(name string) ([]string, error) {
+	var sealed, opaque []string
+	for _, key := range c.epochKeys() {
+		infix, err := sealedInfix(key.SecretKey, name)
+		if err != nil {
+			return nil, err
+		}
+		sealed = append(sealed, infix)
+		if infix, err = opaqueInfix(key.SecretKey, name); err != nil {
+			return nil, err
+		}
+		opaque = append(opaque, infix)
+	}
+	if c.Config.OpaqueNames {
+		return append(append(sealed, opaque...), name), nil
+	}
+	return append(append([]string{name}, sealed...), opaque...), nil
+}
+
+// ObjectName returns the readable name of a stored object. Sealed infixes are opened locally, but the names behind
+// older opaque infixes require decrypting the header of the object, so callers should remember them. Only the header
+// is downloaded, so the object itself is checked when it is eventually read.
+func (c *Clerk) ObjectName(path string) (string, error) {
+	_, infix, _, err := SplitPath(path)
+	if err != nil {
+		return "", err
+	}
+	if IsSealedInfix(infix) {
+		for _, key := range c.epochKeys() {
+			name, ok, err := openToken(key.SecretKey, PurposeSealedNameMAC, PurposeSealedNameCipher,
+				strings.TrimPrefix(infix, sealedPrefix), sealedNameSize)
+			if err != nil {
+				return "", err
+			}
+			if ok {
+				return name, nil
+			}
+		}
+		return "", fmt.Errorf("infix of object %q was not sealed with any known key", path)
+	}
+	if !IsOpaqueInfix(infix) {
+		return infix, nil
+	}
+	header, err := c.InspectObject(path)
+	if err != nil {
+		return "", err
+	}
+	return header.Name, nil
+}
+
+// DeviceAlias returns the alias that a device is registered under with the watchdemon server when device names are
+// hidden with the given alias key.
+func DeviceAlias(aliasKey, device string) (string, error) {
+	if device == "" {
+		return "", errors.New("device name cannot be empty")
+	}
+	token, err := sealToken(aliasKey, PurposeAliasMAC, PurposeAliasCipher, device, sealedAliasSize)
+	if err != nil {
+		return "", err
+	}
+	return aliasPrefix + token, nil
+}
+
+// PathDevice returns the name of the device that stored an object, opening the alias in its path if there is one.
+func (c *Clerk) PathDevice(path string) (string, error) {
+	directory, _, _, err := SplitPath(path)
+	if err != nil {
+		return "", err
+	}
+	if !isDeviceAlias(directory) {
+		return directory, nil
+	}
+	if c.Config.DeviceAliasKey == "" {
+		return "", fmt.Errorf("object %q was stored under a device alias, but no device alias key is configured", path)
+	}
+	device, ok, err := openToken(c.Config.DeviceAliasKey, PurposeAliasMAC, PurposeAliasCipher,
+		strings.TrimPrefix(directory, aliasPrefix), sealedAliasSize)
+	if err != nil {
+		return "", err
+	}
+	if !ok {
+		return "", fmt.Errorf("device alias of object %q was not sealed with the configured device alias key", path)
+	}
+	return device, nil
+}
@@ -0,0 +1,95 @@
+package cryptapi
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSealedInfix(t *testing.T) {
+	c := &Clerk{Config: ClerkConfig{SecretKey: "current", Epoch: 1, OpaqueNames: true,
+		Keyring: []KeyEpoch{{Epoch: 0, SecretKey: "previous"}}}}
+	for _, name := range []string{"push-3-7", "upload-" + strings.Repeat("a", 64)} {
+		infix, err := c.ObjectInfix(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !IsSealedInfix(infix) || strings.Contains(infix, name) {
+			t.Errorf("infix %q for name %q is not sealed", infix, name)
+		}
+		// names are recovered without the remote, which this clerk does not have
+		recovered, err := c.ObjectName("A/" + infix + "#hash")
+		if err != nil || recovered != name {
+			t.Errorf("sealed infix for %q opened as %q: %v", name, recovered, err)
+		}
+	}
+	// names must not be distinguishable by the lengths of their infixes
+	short, _ := c.ObjectInfix("push-1-1")
+	long, _ := c.ObjectInfix("push-1000-1000")
+	if len(short) != len(long) {
+		t.Error("sealed infixes reveal the lengths of their names")
+	}
+	// objects sealed in an earlier epoch remain readable
+	old, err := sealedInfix("previous", "push-1-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if recovered, err := c.ObjectName("A/" + old + "#hash"); err != nil || recovered != "push-1-1" {
+		t.Errorf("infix from an earlier epoch opened as %q: %v", recovered, err)
+	}
+	other, err := sealedInfix("unrelated", "push-1-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.ObjectName("A/" + other + "#hash"); err == nil {
+		t.Error("infix sealed with an unknown key was opened")
+	}
+	if _, err := c.ObjectInfix(strings.Repeat("x", sealedNameSize+1)); err == nil {
+		t.Error("name longer than the sealed size was accepted")
+	}
+}
+
+func TestPathDevice(t *testing.T) {
+	c := &Clerk{Config: ClerkConfig{SecretKey: "current", DeviceAliasKey: "aliases"}}
+	alias, err := DeviceAlias("aliases", "laptop")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(alias, "laptop") {
+		t.Errorf("alias %q reveals the device name", alias)
+	}
+	if device, err := c.PathDevice(alias + "/push-1-1#hash"); err != nil || device != "laptop" {
+		t.Errorf("alias opened as %q: %v", device, err)
+	}
+	// devices registered before aliases were configured keep their names
+	if device, err := c.PathDevice("desktop/push-1-1#hash"); err != nil || device != "desktop" {
+		t.Errorf("plain directory opened as %q: %v", device, err)
+	}
+	forged, err := DeviceAlias("unrelated", "laptop")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.PathDevice(forged + "/push-1-1#hash"); err == nil {
+		t.Error("alias sealed with another key was accepted")
+	}
+	c.Config.DeviceAliasKey = ""
+	if _, err := c.PathDevice(alias + "/push-1-1#hash"); err == nil {
+		t.Error("alias was accepted without an alias key")
+	}
+}
+
+func TestCheckHeaderDeviceAlias(t *testing.T) {
+	c := &Clerk{Config: ClerkConfig{SecretKey: "current", DeviceAliasKey: "aliases"}}
+	alias, err := DeviceAlias("aliases", "laptop")
+	if err != nil {
+		t.Fatal(err)
+	}
+	header := &StreamHeader{Version: VersionPlain, Device: "laptop", Infix: "push-1-1"}
+	if err := c.checkHeader(alias+"/push-1-1#hash", header, -1); err != nil {
+		t.Errorf("header from the aliased device was rejected: %v", err)
+	}
+	// a device cannot claim to be another device by writing into its own directory
+	header.Device = "desktop"
+	if err := c.checkHeader(alias+"/push-1-1#hash", header, -1); err == nil {
+		t.Error("header claiming another device was accepted")
+	}
+}
@@ -0,0 +1,91 @@
+package cryptapi
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/bits"
+)
+
+const (
+	PaddingNone  = ""
+	PaddingPadme = "padme"
+)
+
+// padded objects end with the number of padding bytes that precede this suffix
+const paddingSuffixSize = 8
+
+func validatePadding(padding string) error {
+	if padding != PaddingNone && padding != PaddingPadme {
+		return fmt.Errorf("unsupported padding %q", padding)
+	}
+	return nil
+}
+
+// padme rounds a length up so that only O(log log L) bits of it are revealed, with at most 12% overhead.
+// See "Reducing Metadata Leakage from Encrypted Files and Communication with PURBs" (Nikitin et al., 2019).
+func padme(length uint64) uint64 {
+	if length < 2 {
+		return length
+	}
+	e := uint64(bits.Len64(length) - 1)
+	s := uint64(bits.Len64(e))
+	mask := uint64(1)<<(e-s) - 1
+	return (length + mask) &^ mask
+}
+
+// countingWriter tracks how many bytes have been written, so that the padding can be sized.
+type countingWriter struct {
+	w     io.Writer
+	count uint64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.count += uint64(n)
+	return n, err
+}
+
+// writePadding pads everything written so far, plus the suffix itself, up to the padded length.
+func writePadding(w io.Writer, written uint64) error {
+	total := written + paddingSuffixSize
+	padding := padme(total) - total
+	if _, err := io.CopyN(w, zeroReader{}, int64(padding)); err != nil {
+		return err
+	}
+	return binary.Write(w, binary.BigEndian, padding)
+}
+
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 0
+	}
+	return len(p), nil
+}
+
+// stripPadding returns a reader over the payload that precedes the padding, given the remainder of the object after
+// its header.
+func stripPadding(r io.ReadSeeker) (io.Reader, error) {
+	start, err := r.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return nil, err
+	}
+	end, err := r.Seek(-paddingSuffixSize, io.SeekEnd)
+	if err != nil {
+		return nil, errors.New("padded object too short to contain padding length")
+	}
+	var padding uint64
+	if err := binary.Read(r, binary.BigEndian, &padding); err != nil {
+		return nil, err
+	}
+	if end < start || padding > uint64(end-start) {
+		return nil, errors.New("padded object claims more padding than it contains")
+	}
+	if _, err := r.Seek(start, io.SeekStart); err != nil {
+		return nil, err
+	}
+	return io.LimitReader(r, end-start-int64(padding)), nil
+}
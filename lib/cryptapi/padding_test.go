@@ -0,0 +1,90 @@
+package cryptapi
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"testing"
+)
+
+func TestPadme(t *testing.T) {
+	for length, expected := range map[uint64]uint64{
+		0:       0,
+		1:       1,
+		2:       2,
+		3:       3,
+		9:       10,
+		100:     104,
+		1000:    1024,
+		1 << 20: 1 << 20,
+	} {
+		if padded := padme(length); padded != expected {
+			t.Errorf("padme(%d) = %d, expected %d", length, padded, expected)
+		}
+	}
+	var previous uint64
+	for length := uint64(1); length < 1<<16; length++ {
+		padded := padme(length)
+		if padded < length || padded < previous {
+			t.Fatalf("padme(%d) = %d is not a monotonic upper bound", length, padded)
+		}
+		if length >= 256 && float64(padded) > float64(length)*1.12 {
+			t.Fatalf("padme(%d) = %d has more than 12%% overhead", length, padded)
+		}
+		previous = padded
+	}
+}
+
+// padPayload builds a padded object as it appears after decryption: a header, the payload, and then the padding.
+func padPayload(t *testing.T, header, payload []byte) []byte {
+	var buf bytes.Buffer
+	counter := &countingWriter{w: &buf}
+	if _, err := counter.Write(header); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := counter.Write(payload); err != nil {
+		t.Fatal(err)
+	}
+	if err := writePadding(counter, counter.count); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestPaddingRoundTrip(t *testing.T) {
+	header := []byte("header")
+	for _, size := range []int{0, 1, 100, 4096, 100000} {
+		payload := bytes.Repeat([]byte{0xa5}, size)
+		padded := padPayload(t, header, payload)
+		unpadded := uint64(len(header) + size + paddingSuffixSize)
+		if uint64(len(padded)) != padme(unpadded) {
+			t.Errorf("size %d: padded to %d bytes instead of %d", size, len(padded), padme(unpadded))
+		}
+		r := bytes.NewReader(padded)
+		if _, err := r.Seek(int64(len(header)), io.SeekStart); err != nil {
+			t.Fatal(err)
+		}
+		stripped, err := stripPadding(r)
+		if err != nil {
+			t.Fatalf("size %d: %v", size, err)
+		}
+		result, err := io.ReadAll(stripped)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(result, payload) {
+			t.Errorf("size %d: stripped payload has %d bytes", size, len(result))
+		}
+	}
+}
+
+func TestStripPaddingInvalid(t *testing.T) {
+	if _, err := stripPadding(bytes.NewReader([]byte{1, 2, 3})); err == nil {
+		t.Error("object shorter than the padding suffix was accepted")
+	}
+	excessive := make([]byte, 16)
+	binary.BigEndian.PutUint64(excessive[8:], 9)
+	if _, err := stripPadding(bytes.NewReader(excessive)); err == nil {
+		t.Error("object claiming more padding than it contains was accepted")
+	}
+}
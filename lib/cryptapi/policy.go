@@ -0,0 +1,308 @@
+package cryptapi
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const policySignaturePrefix = "nightmarket-policy-v1\x00"
+
+// policy objects are stored as "policy-<serial>"
+const policyInfixType = "policy"
+
+// Policy is published into the space by its administrator, and applies to every device that is configured with the
+// administrator's key, so that these settings do not have to be kept consistent by hand.
+type Policy struct {
+	// each new policy must have a higher serial than the last
+	Serial uint64 `json:"serial"`
+	// if set, takes the place of the roster installed on each device
+	Roster *Roster `json:"roster,omitempty"`
+	// devices that use a lower age work factor refuse to start
+	MinWorkFactor int `json:"min-work-factor,omitempty"`
+	// if set, every object must be signed by a device in the roster
+	RequireSignatures bool `json:"require-signatures,omitempty"`
+	// the types of object that devices may upload, such as "push" or "upload"; if empty, every type is allowed
+	AllowedInfixTypes []string        `json:"allowed-infix-types,omitempty"`
+	Retention         RetentionPolicy `json:"retention,omitempty"`
+}
+
+type RetentionPolicy struct {
+	// objects may only be deleted (such as by rekey or repair) once they are at least this many days old
+	MinAgeDays int `json:"min-age-days,omitempty"`
+}
+
+// SignedPolicy is a Policy signed by the space administrator.
+type SignedPolicy struct {
+	// kept as opaque bytes, so that reformatting cannot change what was signed
+	Policy    []byte `json:"policy"`
+	Signature []byte `json:"signature"`
+}
+
+// InfixType returns the type of object that a readable name refers to, which is the part before the first dash.
+func InfixType(name string) string {
+	return strings.SplitN(name, "-", 2)[0]
+}
+
+func (p *Policy) Validate() error {
+	if p.Serial == 0 {
+		return errors.New("policy serial must be at least 1")
+	}
+	if p.Roster != nil {
+		if err := p.Roster.Validate(); err != nil {
+			return err
+		}
+	}
+	if p.MinWorkFactor < 0 || p.MinWorkFactor > maxWorkFactor {
+		return errors.New("policy has an invalid minimum work factor")
+	}
+	if p.RequireSignatures && p.Roster == nil {
+		return errors.New("policy requires signatures, but does not provide a roster to verify them with")
+	}
+	for _, infixType := range p.AllowedInfixTypes {
+		if infixType == "" || strings.Contains(infixType, "-") {
+			return fmt.Errorf("policy allows invalid infix type %q", infixType)
+		}
+	}
+	if p.Retention.MinAgeDays < 0 {
+		return errors.New("policy has an invalid retention period")
+	}
+	return nil
+}
+
+func SignPolicy(policy Policy, adminPrivateKey string) (*SignedPolicy, error) {
+	if err := policy.Validate(); err != nil {
+		return nil, err
+	}
+	key, err := parsePrivateKey("admin private key", adminPrivateKey)
+	if err != nil {
+		return nil, err
+	}
+	data, err := json.Marshal(policy)
+	if err != nil {
+		return nil, err
+	}
+	return &SignedPolicy{
+		Policy:    data,
+		Signature: ed25519.Sign(key, append([]byte(policySignaturePrefix), data...)),
+	}, nil
+}
+
+// AdminPublicKey returns the public key that corresponds to an admin private key.
+func AdminPublicKey(adminPrivateKey string) (string, error) {
+	key, err := parsePrivateKey("admin private key", adminPrivateKey)
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(key.Public().(ed25519.PublicKey)), nil
+}
+
+// Verify checks the administrator's signature, and only then decodes the policy.
+func (sp *SignedPolicy) Verify(adminPublicKey string) (*Policy, error) {
+	key, err := parsePublicKey("admin key", adminPublicKey)
+	if err != nil {
+		return nil, err
+	}
+	if !ed25519.Verify(key, append([]byte(policySignaturePrefix), sp.Policy...), sp.Signature) {
+		return nil, errors.New("policy signature is not valid for the configured admin key")
+	}
+	var policy Policy
+	if err := json.Unmarshal(sp.Policy, &policy); err != nil {
+		return nil, err
+	}
+	if err := policy.Validate(); err != nil {
+		return nil, err
+	}
+	return &policy, nil
+}
+
+// LoadPolicy finds the newest policy in the space that is signed by the administrator, and enforces it. The space is
+// only accessed once this has been called, so that constructing a clerk merely to validate a configuration stays
+// offline. lastSerial is the newest policy serial that the caller has seen from this space before; finding an older
+// policy, or none at all, means that the space may have been rolled back. The serial to remember for next time is
+// returned.
+func (c *Clerk) LoadPolicy(lastSerial uint64) (uint64, error) {
+	if c.Config.AdminKey == "" {
+		c.policyLoaded = true
+		return lastSerial, nil
+	}
+	if !c.policyLoaded {
+		if err := c.findPolicy(); err != nil {
+			return 0, err
+		}
+	}
+	var serial uint64
+	if c.Policy != nil {
+		serial = c.Policy.Serial
+	}
+	if serial < lastSerial {
+		return 0, fmt.Errorf("security alert: the space's policy has serial %d, but serial %d was already seen: the "+
+			"remote may have been rolled back", serial, lastSerial)
+	}
+	if c.policyLoaded {
+		return serial, nil
+	}
+	if c.Config.RequirePolicy && c.Policy == nil {
+		return 0, errors.New("configuration requires a policy, but none signed by the admin key was found")
+	}
+	if c.Policy != nil && c.Policy.Roster != nil {
+		if err := c.useRoster(c.Policy.Roster); err != nil {
+			return 0, err
+		}
+	} else if c.Roster == nil && c.needsRoster() {
+		if err := c.loadRoster(); err != nil {
+			return 0, err
+		}
+	}
+	if c.Policy != nil {
+		if err := c.applyPolicy(); err != nil {
+			return 0, err
+		}
+	}
+	c.policyLoaded = true
+	return serial, nil
+}
+
+// checkPolicyLoaded makes sure that LoadPolicy was called, so that the policy cannot be skipped by accident.
+func (c *Clerk) checkPolicyLoaded() error {
+	if !c.policyLoaded && c.Config.AdminKey != "" {
+		return errors.New("internal error: the space's policy has not been loaded")
+	}
+	return nil
+}
+
+// findPolicy finds the newest policy in the space that is signed by the administrator. Objects that merely claim to
+// be policies are ignored, because any device can upload them.
+func (c *Clerk) findPolicy() error {
+	objects, err := c.ListObjects()
+	if err != nil {
+		return err
+	}
+	var newest *Policy
+	var newestData []byte
+	for _, objectPath := range objects {
+		_, infix, _, err := SplitPath(objectPath)
+		if err != nil {
+			return err
+		}
+		if InfixType(infix) != policyInfixType {
+			continue
+		}
+		policy, data, err := c.readPolicy(objectPath)
+		if err != nil {
+			_, _ = fmt.Fprintf(os.Stderr, "nightmarket: ignoring policy object %q: %v\n", objectPath, err)
+			continue
+		}
+		if newest != nil && policy.Serial == newest.Serial && !bytes.Equal(data, newestData) {
+			return fmt.Errorf("security alert: found conflicting policies with serial %d", policy.Serial)
+		}
+		if newest == nil || policy.Serial > newest.Serial {
+			newest, newestData = policy, data
+		}
+	}
+	c.Policy = newest
+	return nil
+}
+
+func (c *Clerk) readPolicy(objectPath string) (*Policy, []byte, error) {
+	// policies are authenticated by the administrator's signature rather than by the signature of the device that
+	// uploaded them, since the roster to check device signatures against may come from the policy itself
+	_, rc, err := c.getDecryptObjectStream(objectPath, false)
+	if err != nil {
+		return nil, nil, err
+	}
+	var signed SignedPolicy
+	err = json.NewDecoder(rc).Decode(&signed)
+	if err2 := rc.Close(); err == nil {
+		err = err2
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	policy, err := signed.Verify(c.Config.AdminKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	return policy, signed.Policy, nil
+}
+
+// applyPolicy enforces the parts of the policy that concern the configuration of this device.
+func (c *Clerk) applyPolicy() error {
+	p := c.Policy
+	workFactor := c.Config.WorkFactor
+	if workFactor == 0 {
+		workFactor = defaultWorkFactor
+	}
+	if workFactor < p.MinWorkFactor {
+		return fmt.Errorf("policy requires a work factor of at least %d, but this device uses %d",
+			p.MinWorkFactor, workFactor)
+	}
+	if p.RequireSignatures {
+		if c.signingKey == nil {
+			return errors.New("policy requires signatures, but this device has no signing key configured")
+		}
+		c.Config.RequireSignatures = true
+	}
+	return nil
+}
+
+// PublishPolicy uploads a new policy, which must have a higher serial than the current one.
+func (c *Clerk) PublishPolicy(signed *SignedPolicy) (string, error) {
+	policy, err := signed.Verify(c.Config.AdminKey)
+	if err != nil {
+		return "", err
+	}
+	if c.Policy != nil && policy.Serial <= c.Policy.Serial {
+		return "", fmt.Errorf("policy serial %d is not newer than current serial %d", policy.Serial, c.Policy.Serial)
+	}
+	data, err := json.Marshal(signed)
+	if err != nil {
+		return "", err
+	}
+	name := policyInfixType + "-" + strconv.FormatUint(policy.Serial, 10)
+	return c.PutEncryptObjectStreamWithInfo(name, bytes.NewReader(data), ObjectInfo{
+		Kind:   KindPolicy,
+		Length: int64(len(data)),
+	})
+}
+
+// CheckUpload reports an error if the policy does not allow uploading objects with this readable name.
+func (c *Clerk) CheckUpload(name string) error {
+	if err := c.checkPolicyLoaded(); err != nil {
+		return err
+	}
+	if c.Policy == nil || len(c.Policy.AllowedInfixTypes) == 0 || InfixType(name) == policyInfixType {
+		return nil
+	}
+	for _, allowed := range c.Policy.AllowedInfixTypes {
+		if InfixType(name) == allowed {
+			return nil
+		}
+	}
+	return fmt.Errorf("policy does not allow uploading objects of type %q", InfixType(name))
+}
+
+// CheckDeletion reports an error if the policy requires the object with this header to be retained.
+func (c *Clerk) CheckDeletion(header *StreamHeader) error {
+	if err := c.checkPolicyLoaded(); err != nil {
+		return err
+	}
+	// objects from before creation times were recorded are necessarily old
+	if c.Policy == nil || c.Policy.Retention.MinAgeDays == 0 || header.CreatedMs == 0 {
+		return nil
+	}
+	retention := time.Duration(c.Policy.Retention.MinAgeDays) * 24 * time.Hour
+	age := time.Since(time.UnixMilli(header.CreatedMs))
+	if age < retention {
+		return fmt.Errorf("policy retains objects for %d days, but this object is only %s old",
+			c.Policy.Retention.MinAgeDays, age.Truncate(time.Minute))
+	}
+	return nil
+}
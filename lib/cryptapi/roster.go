@@ -0,0 +1,208 @@
+package cryptapi
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+
+	"filippo.io/age"
+)
+
+const rosterSignaturePrefix = "nightmarket-roster-v1\x00"
+
+// Roster lists the devices that objects in a space are encrypted to. Removing a device from the roster (and
+// increasing the serial) excludes it from all objects encrypted afterwards.
+type Roster struct {
+	Serial  uint64                  `json:"serial"`
+	Devices map[string]RosterDevice `json:"devices"`
+}
+
+type RosterDevice struct {
+	// age X25519 recipient for this device, such as "age1..."
+	Recipient string `json:"recipient"`
+	// ed25519 public key that this device signs objects with, if any
+	VerifyKey string `json:"verify-key,omitempty"`
+	// objects that this device created before this time (in Unix milliseconds) predate its verify key, and are still
+	// accepted unsigned, with a security alert, since their creation times are not authenticated
+	SignedFromMs int64 `json:"signed-from-ms,omitempty"`
+}
+
+// SignedRoster is a Roster signed by the space administrator, so that it can be distributed through untrusted channels.
+type SignedRoster struct {
+	// the signature covers the compact encoding, so that reformatting the configuration file does not invalidate it
+	Roster    json.RawMessage `json:"roster"`
+	Signature []byte          `json:"signature"`
+}
+
+// GenerateSigningKey produces an ed25519 key pair, as used both by administrators to sign rosters and by devices to
+// sign objects.
+func GenerateSigningKey() (public, private string, err error) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return "", "", err
+	}
+	return base64.StdEncoding.EncodeToString(pub), base64.StdEncoding.EncodeToString(priv.Seed()), nil
+}
+
+func parsePublicKey(what, encoded string) (ed25519.PublicKey, error) {
+	key, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s: %w", what, err)
+	}
+	if len(key) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("invalid %s: wrong length", what)
+	}
+	return key, nil
+}
+
+func parsePrivateKey(what, encoded string) (ed25519.PrivateKey, error) {
+	seed, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s: %w", what, err)
+	}
+	if len(seed) != ed25519.SeedSize {
+		return nil, fmt.Errorf("invalid %s: wrong length", what)
+	}
+	return ed25519.NewKeyFromSeed(seed), nil
+}
+
+func (r *Roster) Validate() error {
+	if len(r.Devices) == 0 {
+		return errors.New("roster does not list any devices")
+	}
+	for device, entry := range r.Devices {
+		if device == "" {
+			return errors.New("roster contains an empty device name")
+		}
+		if _, err := age.ParseX25519Recipient(entry.Recipient); err != nil {
+			return fmt.Errorf("roster entry for device %q: %w", device, err)
+		}
+		if entry.VerifyKey != "" {
+			if _, err := parsePublicKey("verify key", entry.VerifyKey); err != nil {
+				return fmt.Errorf("roster entry for device %q: %w", device, err)
+			}
+		} else if entry.SignedFromMs != 0 {
+			return fmt.Errorf("roster entry for device %q: signed-from-ms requires a verify key", device)
+		}
+	}
+	return nil
+}
+
+// Recipients returns the age recipients of every device in the roster, in a consistent order.
+func (r *Roster) Recipients() ([]age.Recipient, error) {
+	var devices []string
+	for device := range r.Devices {
+		devices = append(devices, device)
+	}
+	sort.Strings(devices)
+	var recipients []age.Recipient
+	for _, device := range devices {
+		recipient, err := age.ParseX25519Recipient(r.Devices[device].Recipient)
+		if err != nil {
+			return nil, fmt.Errorf("roster entry for device %q: %w", device, err)
+		}
+		recipients = append(recipients, recipient)
+	}
+	return recipients, nil
+}
+
+func SignRoster(roster Roster, adminPrivateKey string) (*SignedRoster, error) {
+	if err := roster.Validate(); err != nil {
+		return nil, err
+	}
+	key, err := parsePrivateKey("admin private key", adminPrivateKey)
+	if err != nil {
+		return nil, err
+	}
+	data, err := json.Marshal(roster)
+	if err != nil {
+		return nil, err
+	}
+	return &SignedRoster{
+		Roster:    data,
+		Signature: ed25519.Sign(key, append([]byte(rosterSignaturePrefix), data...)),
+	}, nil
+}
+
+// Verify checks the administrator's signature, and only then decodes the roster.
+func (sr *SignedRoster) Verify(adminPublicKey string) (*Roster, error) {
+	key, err := parsePublicKey("admin key", adminPublicKey)
+	if err != nil {
+		return nil, err
+	}
+	var data bytes.Buffer
+	if err := json.Compact(&data, sr.Roster); err != nil {
+		return nil, err
+	}
+	if !ed25519.Verify(key, append([]byte(rosterSignaturePrefix), data.Bytes()...), sr.Signature) {
+		return nil, errors.New("roster signature is not valid for the configured admin key")
+	}
+	var roster Roster
+	if err := json.Unmarshal(data.Bytes(), &roster); err != nil {
+		return nil, err
+	}
+	if err := roster.Validate(); err != nil {
+		return nil, err
+	}
+	return &roster, nil
+}
+
+// needsRoster returns true if the configuration uses device identities or signatures, which require a roster.
+func (c *Clerk) needsRoster() bool {
+	return c.Config.Roster != nil || c.Config.Identity != "" || c.Config.SigningKey != "" || c.Config.RequireSignatures
+}
+
+func (c *Clerk) loadRoster() error {
+	if c.Config.AdminKey == "" || c.Config.Roster == nil {
+		return errors.New("device identities and signatures require both an admin key and a signed roster")
+	}
+	roster, err := c.Config.Roster.Verify(c.Config.AdminKey)
+	if err != nil {
+		return err
+	}
+	return c.useRoster(roster)
+}
+
+// useRoster checks this device's keys against a verified roster and prepares to encrypt to the devices it lists.
+func (c *Clerk) useRoster(roster *Roster) error {
+	device, err := c.DeviceName()
+	if err != nil {
+		return err
+	}
+	entry, found := roster.Devices[device]
+	if !found {
+		return fmt.Errorf("device %q is not listed in the roster", device)
+	}
+	if c.Config.Identity != "" {
+		identity, err := age.ParseX25519Identity(c.Config.Identity)
+		if err != nil {
+			return err
+		}
+		if entry.Recipient != identity.Recipient().String() {
+			return fmt.Errorf("roster lists a different recipient for device %q than its configured identity", device)
+		}
+		recipients, err := roster.Recipients()
+		if err != nil {
+			return err
+		}
+		c.identity, c.recipients = identity, recipients
+	}
+	if c.Config.SigningKey != "" {
+		signingKey, err := parsePrivateKey("signing key", c.Config.SigningKey)
+		if err != nil {
+			return err
+		}
+		public := base64.StdEncoding.EncodeToString(signingKey.Public().(ed25519.PublicKey))
+		if entry.VerifyKey != public {
+			return fmt.Errorf("roster lists a different verify key for device %q than its configured signing key", device)
+		}
+		c.signingKey = signingKey
+	}
+	c.Roster = roster
+	return nil
+}
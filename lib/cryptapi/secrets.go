@@ -0,0 +1,176 @@
+package cryptapi
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+
+	"filippo.io/age"
+	"filippo.io/age/armor"
+	"github.com/celskeggs/nightmarket/lib/util"
+)
+
+// SecretSource supplies a secret from somewhere other than the configuration file. Exactly one field must be set.
+type SecretSource struct {
+	// a command and its arguments, whose standard output is the secret, such as ["pass", "show", "nightmarket"]
+	Command []string `json:"command,omitempty"`
+	// the name of an environment variable that contains the secret
+	Env string `json:"env,omitempty"`
+	// an inherited file descriptor from which the secret can be read
+	FD *int `json:"fd,omitempty"`
+}
+
+// file descriptors can only be read once, so their contents are kept for the rest of the process
+var fdSecretsLock sync.Mutex
+var fdSecrets = map[int]string{}
+
+func readFDSecret(fd int) (string, error) {
+	fdSecretsLock.Lock()
+	defer fdSecretsLock.Unlock()
+	if secret, found := fdSecrets[fd]; found {
+		return secret, nil
+	}
+	f := os.NewFile(uintptr(fd), fmt.Sprintf("secret-fd-%d", fd))
+	if f == nil {
+		return "", fmt.Errorf("invalid secret file descriptor %d", fd)
+	}
+	data, err := io.ReadAll(f)
+	if err2 := f.Close(); err == nil {
+		err = err2
+	}
+	if err != nil {
+		return "", fmt.Errorf("while reading secret from file descriptor %d: %w", fd, err)
+	}
+	fdSecrets[fd] = string(data)
+	return string(data), nil
+}
+
+func (s *SecretSource) Read() (string, error) {
+	var secret string
+	switch {
+	case len(s.Command) > 0 && s.Env == "" && s.FD == nil:
+		cmd := exec.Command(s.Command[0], s.Command[1:]...)
+		cmd.Stderr = os.Stderr
+		output, err := cmd.Output()
+		if err != nil {
+			return "", fmt.Errorf("while running secret command %q: %w", s.Command[0], err)
+		}
+		secret = string(output)
+	case len(s.Command) == 0 && s.Env != "" && s.FD == nil:
+		value, found := os.LookupEnv(s.Env)
+		if !found {
+			return "", fmt.Errorf("secret environment variable %q is not set", s.Env)
+		}
+		secret = value
+	case len(s.Command) == 0 && s.Env == "" && s.FD != nil:
+		value, err := readFDSecret(*s.FD)
+		if err != nil {
+			return "", err
+		}
+		secret = value
+	default:
+		return "", errors.New("secret source must specify exactly one of command, env, or fd")
+	}
+	secret = strings.TrimRight(secret, "\r\n")
+	if secret == "" {
+		return "", errors.New("secret source supplied an empty secret")
+	}
+	return secret, nil
+}
+
+// resolveSecrets fills in any secrets that are supplied by secret sources.
+func resolveSecrets(config ClerkConfig) (ClerkConfig, error) {
+	if config.SecretKeySource != nil {
+		if config.SecretKey != "" {
+			return ClerkConfig{}, errors.New("secret-key and secret-key-source cannot both be set")
+		}
+		secret, err := config.SecretKeySource.Read()
+		if err != nil {
+			return ClerkConfig{}, err
+		}
+		config.SecretKey = secret
+	}
+	if config.TokenSource != nil {
+		if config.SpaceConfig.DeviceToken != "" {
+			return ClerkConfig{}, errors.New("token and token-source cannot both be set")
+		}
+		secret, err := config.TokenSource.Read()
+		if err != nil {
+			return ClerkConfig{}, err
+		}
+		config.SpaceConfig.DeviceToken = secret
+	}
+	return config, nil
+}
+
+// ConfigIdentityEnv names an environment variable with the path to an age identity file, which is used to decrypt
+// encrypted configuration files. If it is not set, a passphrase is requested on the terminal instead.
+const ConfigIdentityEnv = "NIGHTMARKET_IDENTITY"
+
+const ageHeader = "age-encryption.org/v1\n"
+
+func isEncrypted(data []byte) bool {
+	return bytes.HasPrefix(data, []byte(ageHeader)) || bytes.HasPrefix(data, []byte(armor.Header))
+}
+
+// IsEncryptedConfig reports whether a configuration file has been encrypted with age.
+func IsEncryptedConfig(configPath string) (bool, error) {
+	f, err := os.Open(configPath)
+	if err != nil {
+		return false, err
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+	prefix := make([]byte, len(armor.Header))
+	n, err := io.ReadFull(f, prefix)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return false, err
+	}
+	return isEncrypted(prefix[:n]), nil
+}
+
+func configIdentities(configPath string) ([]age.Identity, error) {
+	if identityPath := os.Getenv(ConfigIdentityEnv); identityPath != "" {
+		f, err := os.Open(identityPath)
+		if err != nil {
+			return nil, err
+		}
+		defer func() {
+			_ = f.Close()
+		}()
+		return age.ParseIdentities(f)
+	}
+	passphrase, err := util.PromptTerminal(fmt.Sprintf("Passphrase for %q: ", configPath))
+	if err != nil {
+		return nil, fmt.Errorf("configuration %q is encrypted: set %s or run from a terminal: %w",
+			configPath, ConfigIdentityEnv, err)
+	}
+	identity, err := age.NewScryptIdentity(passphrase)
+	if err != nil {
+		return nil, err
+	}
+	return []age.Identity{identity}, nil
+}
+
+func decryptConfig(configPath string, data []byte) ([]byte, error) {
+	identities, err := configIdentities(configPath)
+	if err != nil {
+		return nil, err
+	}
+	var ciphertext io.Reader = bytes.NewReader(data)
+	if bytes.HasPrefix(data, []byte(armor.Header)) {
+		ciphertext = armor.NewReader(bufio.NewReader(ciphertext))
+	}
+	plaintext, err := age.Decrypt(ciphertext, identities...)
+	if err != nil {
+		return nil, fmt.Errorf("while decrypting configuration %q: %w", configPath, err)
+	}
+	return io.ReadAll(plaintext)
+}
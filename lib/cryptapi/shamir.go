@@ -0,0 +1,93 @@
+package cryptapi
+
+import (
+	"crypto/rand"
+	"errors"
+)
+
+// Shamir's secret sharing over GF(2^8), applied independently to each byte of the secret. Shares are evaluated at
+// x = 1..n, and the secret is the value of the polynomial at x = 0.
+
+// gfMul multiplies in GF(2^8) with the AES polynomial, without any data-dependent branches or table lookups.
+func gfMul(a, b byte) byte {
+	var product byte
+	for i := 0; i < 8; i++ {
+		product ^= -(b & 1) & a
+		// reduce by x^8 + x^4 + x^3 + x + 1 whenever the high bit shifts out
+		a = (a << 1) ^ (-(a >> 7) & 0x1b)
+		b >>= 1
+	}
+	return product
+}
+
+// gfInv computes a^254, which is the multiplicative inverse of any nonzero a.
+func gfInv(a byte) byte {
+	result := byte(1)
+	for i := 0; i < 254; i++ {
+		result = gfMul(result, a)
+	}
+	return result
+}
+
+// shamirSplit produces n shares of secret, any threshold of which reconstruct it. Share i is evaluated at x = i+1.
+func shamirSplit(secret []byte, threshold, n int) ([][]byte, error) {
+	if threshold < 2 || threshold > n || n > 255 {
+		return nil, errors.New("invalid threshold or share count")
+	}
+	shares := make([][]byte, n)
+	for i := range shares {
+		shares[i] = make([]byte, len(secret))
+	}
+	coefficients := make([]byte, threshold)
+	for j, b := range secret {
+		coefficients[0] = b
+		if _, err := rand.Read(coefficients[1:]); err != nil {
+			return nil, err
+		}
+		for i := range shares {
+			x := byte(i + 1)
+			// Horner's method, from the highest coefficient down
+			var y byte
+			for k := threshold - 1; k >= 0; k-- {
+				y = gfMul(y, x) ^ coefficients[k]
+			}
+			shares[i][j] = y
+		}
+	}
+	for k := range coefficients {
+		coefficients[k] = 0
+	}
+	return shares, nil
+}
+
+// shamirCombine interpolates the secret from shares evaluated at the corresponding xs, which must be distinct and
+// nonzero.
+func shamirCombine(xs []byte, shares [][]byte) ([]byte, error) {
+	if len(xs) != len(shares) || len(xs) == 0 {
+		return nil, errors.New("mismatched shares")
+	}
+	for i := range xs {
+		if xs[i] == 0 || len(shares[i]) != len(shares[0]) {
+			return nil, errors.New("malformed share")
+		}
+		for j := 0; j < i; j++ {
+			if xs[i] == xs[j] {
+				return nil, errors.New("duplicate share")
+			}
+		}
+	}
+	secret := make([]byte, len(shares[0]))
+	for i := range xs {
+		// Lagrange basis polynomial for share i, evaluated at zero (subtraction is XOR in this field)
+		basis := byte(1)
+		for j := range xs {
+			if i != j {
+				basis = gfMul(basis, gfMul(xs[j], gfInv(xs[i]^xs[j])))
+			}
+		}
+		for k := range secret {
+			secret[k] ^= gfMul(basis, shares[i][k])
+		}
+	}
+	return secret, nil
+}
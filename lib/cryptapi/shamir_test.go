@@ -0,0 +1,81 @@
+package cryptapi
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestGFInverse(t *testing.T) {
+	for a := 1; a < 256; a++ {
+		if product := gfMul(byte(a), gfInv(byte(a))); product != 1 {
+			t.Errorf("%d * inverse(%d) = %d", a, a, product)
+		}
+	}
+}
+
+func TestShamirRoundTrip(t *testing.T) {
+	secret := []byte("correct horse battery staple")
+	shares, err := shamirSplit(secret, 3, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// every subset of exactly the threshold must reconstruct the secret
+	for a := 0; a < 5; a++ {
+		for b := a + 1; b < 5; b++ {
+			for c := b + 1; c < 5; c++ {
+				xs := []byte{byte(a + 1), byte(b + 1), byte(c + 1)}
+				combined, err := shamirCombine(xs, [][]byte{shares[a], shares[b], shares[c]})
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(combined, secret) {
+					t.Errorf("shares %v reconstructed %q", xs, combined)
+				}
+			}
+		}
+	}
+	// so must every share together, in any order
+	combined, err := shamirCombine([]byte{5, 3, 1, 4, 2}, [][]byte{shares[4], shares[2], shares[0], shares[3], shares[1]})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(combined, secret) {
+		t.Errorf("all shares reconstructed %q", combined)
+	}
+}
+
+func TestShamirBelowThreshold(t *testing.T) {
+	secret := bytes.Repeat([]byte{0x5a}, 64)
+	shares, err := shamirSplit(secret, 3, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	combined, err := shamirCombine([]byte{1, 2}, shares[:2])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(combined, secret) {
+		t.Error("two of three shares reconstructed the secret")
+	}
+}
+
+func TestShamirInvalid(t *testing.T) {
+	for _, params := range [][2]int{{1, 3}, {4, 3}, {2, 256}} {
+		if _, err := shamirSplit([]byte("secret"), params[0], params[1]); err == nil {
+			t.Errorf("split with threshold %d of %d did not fail", params[0], params[1])
+		}
+	}
+	shares, err := shamirSplit([]byte("secret"), 2, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := shamirCombine([]byte{1, 1}, shares[:2]); err == nil {
+		t.Error("combine with duplicate shares did not fail")
+	}
+	if _, err := shamirCombine([]byte{0, 1}, shares[:2]); err == nil {
+		t.Error("combine with a share at zero did not fail")
+	}
+	if _, err := shamirCombine([]byte{1, 2}, [][]byte{shares[0], shares[1][:3]}); err == nil {
+		t.Error("combine with shares of different lengths did not fail")
+	}
+}
@@ -0,0 +1,100 @@
+package cryptapi
+
+import (
+	"crypto/ed25519"
+	"errors"
+	"fmt"
+	"io"
+)
+
+const objectSignaturePrefix = "nightmarket-object-v1\x00"
+
+// signedMessage binds a signature to the digest of the object's header and payload.
+func signedMessage(digest []byte) []byte {
+	return append([]byte(objectSignaturePrefix), digest...)
+}
+
+func (c *Clerk) signObject(digest []byte) ([]byte, error) {
+	if c.signingKey == nil {
+		return nil, errors.New("no signing key configured")
+	}
+	return ed25519.Sign(c.signingKey, signedMessage(digest)), nil
+}
+
+func (c *Clerk) verifyObject(device string, digest, signature []byte) error {
+	if c.Roster == nil {
+		return fmt.Errorf("cannot verify object signed by device %q: no roster configured", device)
+	}
+	entry, found := c.Roster.Devices[device]
+	if !found {
+		return fmt.Errorf("cannot verify object signed by device %q: not listed in the roster", device)
+	}
+	if entry.VerifyKey == "" {
+		return fmt.Errorf("cannot verify object signed by device %q: roster lists no verify key", device)
+	}
+	key, err := parsePublicKey("verify key", entry.VerifyKey)
+	if err != nil {
+		return err
+	}
+	if !ed25519.Verify(key, signedMessage(digest), signature) {
+		return fmt.Errorf("security alert: invalid signature on object from device %q", device)
+	}
+	return nil
+}
+
+// trailerReader passes through everything from the underlying reader except for the final Size bytes, which are
+// withheld and made available through Trailer once the underlying reader is exhausted.
+type trailerReader struct {
+	r    io.Reader
+	size int
+	held []byte
+	eof  bool
+}
+
+func newTrailerReader(r io.Reader, size int) *trailerReader {
+	return &trailerReader{r: r, size: size}
+}
+
+func (t *trailerReader) Read(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	for {
+		if len(t.held) > t.size {
+			n := copy(p, t.held[:len(t.held)-t.size])
+			t.held = t.held[n:]
+			return n, nil
+		}
+		if t.eof {
+			return 0, io.EOF
+		}
+		chunk := make([]byte, len(p)+t.size)
+		n, err := t.r.Read(chunk)
+		t.held = append(t.held, chunk[:n]...)
+		if err == io.EOF {
+			t.eof = true
+		} else if err != nil {
+			return 0, err
+		}
+	}
+}
+
+func (t *trailerReader) Trailer() ([]byte, error) {
+	if !t.eof {
+		return nil, errors.New("trailer requested before end of stream")
+	}
+	if len(t.held) != t.size {
+		return nil, errors.New("stream too short to contain trailer")
+	}
+	return t.held, nil
+}
+
+// mustBeSigned returns true if the roster lists a verify key for the object's device that was in use when the object
+// was created, so that the object must have been signed.
+func (c *Clerk) mustBeSigned(header *StreamHeader) bool {
+	if c.Roster == nil {
+		return false
+	}
+	entry := c.Roster.Devices[header.Device]
+	return entry.VerifyKey != "" && header.CreatedMs >= entry.SignedFromMs
+}
@@ -0,0 +1,176 @@
+package cryptapi
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"strings"
+	"testing"
+	"testing/iotest"
+
+	"filippo.io/age"
+)
+
+func TestTrailerReader(t *testing.T) {
+	data := []byte("the payload, followed by a trailer")
+	for _, size := range []int{0, 1, 7, len(data)} {
+		for _, oneByte := range []bool{false, true} {
+			var r io.Reader = bytes.NewReader(data)
+			if oneByte {
+				r = iotest.OneByteReader(r)
+			}
+			trailer := newTrailerReader(r, size)
+			payload, err := io.ReadAll(trailer)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(payload, data[:len(data)-size]) {
+				t.Errorf("size %d: payload was %q", size, payload)
+			}
+			held, err := trailer.Trailer()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(held, data[len(data)-size:]) {
+				t.Errorf("size %d: trailer was %q", size, held)
+			}
+		}
+	}
+}
+
+func TestTrailerReaderErrors(t *testing.T) {
+	trailer := newTrailerReader(strings.NewReader("short"), 8)
+	if _, err := trailer.Trailer(); err == nil {
+		t.Error("trailer was available before the end of the stream")
+	}
+	payload, err := io.ReadAll(trailer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(payload) != 0 {
+		t.Errorf("short stream produced payload %q", payload)
+	}
+	if _, err := trailer.Trailer(); err == nil {
+		t.Error("stream shorter than its trailer was accepted")
+	}
+}
+
+func signingClerk(t *testing.T) *Clerk {
+	public, private, err := GenerateSigningKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	signingKey, err := parsePrivateKey("signing key", private)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &Clerk{
+		Roster: &Roster{
+			Serial: 1,
+			Devices: map[string]RosterDevice{
+				"signer":   {VerifyKey: public},
+				"unsigned": {},
+			},
+		},
+		signingKey: signingKey,
+	}
+}
+
+func TestObjectSignature(t *testing.T) {
+	c := signingClerk(t)
+	digest := sha256.Sum256([]byte("object contents"))
+	signature, err := c.signObject(digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(signature) != ed25519.SignatureSize {
+		t.Errorf("signature has %d bytes", len(signature))
+	}
+	if err := c.verifyObject("signer", digest[:], signature); err != nil {
+		t.Errorf("valid signature was rejected: %v", err)
+	}
+	tampered := sha256.Sum256([]byte("other contents"))
+	if err := c.verifyObject("signer", tampered[:], signature); err == nil {
+		t.Error("signature was accepted for a different digest")
+	}
+	if err := c.verifyObject("unsigned", digest[:], signature); err == nil {
+		t.Error("signature was accepted from a device without a verify key")
+	}
+	if err := c.verifyObject("unknown", digest[:], signature); err == nil {
+		t.Error("signature was accepted from a device that is not in the roster")
+	}
+}
+
+func TestMustBeSigned(t *testing.T) {
+	c := signingClerk(t)
+	signer := c.Roster.Devices["signer"]
+	signer.SignedFromMs = 1000
+	c.Roster.Devices["cutover"] = signer
+	for _, test := range []struct {
+		device    string
+		createdMs int64
+		signed    bool
+	}{
+		{"signer", 0, true},
+		{"signer", 500, true},
+		{"unsigned", 2000, false},
+		{"unknown", 2000, false},
+		// objects from before the verify key was added, including those that do not record when they were created
+		{"cutover", 0, false},
+		{"cutover", 999, false},
+		{"cutover", 1000, true},
+		{"cutover", 2000, true},
+	} {
+		header := &StreamHeader{Device: test.device, CreatedMs: test.createdMs}
+		if signed := c.mustBeSigned(header); signed != test.signed {
+			t.Errorf("mustBeSigned(%q created at %d) = %v, expected %v", test.device, test.createdMs, signed, test.signed)
+		}
+	}
+}
+
+func TestSignedRosterSurvivesReformatting(t *testing.T) {
+	adminPublic, adminPrivate, err := GenerateSigningKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	identity, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed, err := SignRoster(Roster{
+		Serial:  3,
+		Devices: map[string]RosterDevice{"device": {Recipient: identity.Recipient().String()}},
+	}, adminPrivate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// configuration files are rewritten with indentation, which reformats the embedded roster
+	data, err := json.MarshalIndent(ClerkConfig{Roster: signed}, "", "    ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var config ClerkConfig
+	if err := json.Unmarshal(data, &config); err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(config.Roster.Roster, signed.Roster) {
+		t.Fatal("roster was not reformatted")
+	}
+	roster, err := config.Roster.Verify(adminPublic)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if roster.Serial != 3 {
+		t.Errorf("roster has serial %d", roster.Serial)
+	}
+	config.Roster.Signature[0] ^= 1
+	if _, err := config.Roster.Verify(adminPublic); err == nil {
+		t.Error("roster with a corrupted signature was accepted")
+	}
+	if _, err := signed.Verify(base64.StdEncoding.EncodeToString(make([]byte, ed25519.PublicKeySize))); err == nil {
+		t.Error("roster was accepted under a different admin key")
+	}
+}
@@ -0,0 +1,84 @@
+package cryptapi
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+// key versions describe how the secret key is turned into the keys used by each primitive. Every version remains
+// readable, so that objects and infixes created before a migration can still be located.
+const (
+	// the secret key is used directly, both as the HMAC key and as the age passphrase
+	KeyVersionRaw = 0
+	// independent subkeys are derived from the secret key for each purpose with HKDF
+	KeyVersionSubkeys = 1
+)
+
+// LatestKeyVersion is used for newly created configurations.
+const LatestKeyVersion = KeyVersionSubkeys
+
+const subkeySalt = "nightmarket-subkeys-v1"
+
+// purposes for subkeys; new purposes must never reuse an existing label
+const (
+	PurposeInfixMAC   = "infix-hmac"
+	PurposeEncryption = "encryption"
+)
+
+func validateKeyVersion(version int) error {
+	if version < KeyVersionRaw || version > LatestKeyVersion {
+		return fmt.Errorf("unsupported key version %d", version)
+	}
+	return nil
+}
+
+// keyVersionsFrom lists every key version, starting with the preferred version.
+func keyVersionsFrom(preferred int) []int {
+	versions := []int{preferred}
+	for version := LatestKeyVersion; version >= KeyVersionRaw; version-- {
+		if version != preferred {
+			versions = append(versions, version)
+		}
+	}
+	return versions
+}
+
+func subkey(secretKey string, version int, purpose string) ([]byte, error) {
+	if len(secretKey) == 0 {
+		return nil, errors.New("invalid secret key: length is 0")
+	}
+	switch version {
+	case KeyVersionRaw:
+		return []byte(secretKey), nil
+	case KeyVersionSubkeys:
+		key := make([]byte, 32)
+		if _, err := io.ReadFull(hkdf.New(sha256.New, []byte(secretKey), []byte(subkeySalt), []byte(purpose)), key); err != nil {
+			return nil, err
+		}
+		return key, nil
+	default:
+		return nil, fmt.Errorf("unsupported key version %d", version)
+	}
+}
+
+// passphrase turns a subkey into a passphrase for age's scrypt recipient.
+func passphrase(secretKey string, version int) (string, error) {
+	key, err := subkey(secretKey, version, PurposeEncryption)
+	if err != nil {
+		return "", err
+	}
+	if version == KeyVersionRaw {
+		return secretKey, nil
+	}
+	return hex.EncodeToString(key), nil
+}
+
+// Subkey derives a key for the given purpose from the current secret key.
+func (c *Clerk) Subkey(purpose string) ([]byte, error) {
+	return subkey(c.Config.SecretKey, c.Config.KeyVersion, purpose)
+}
@@ -0,0 +1,40 @@
+package cryptapi
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestSubkey(t *testing.T) {
+	raw, err := subkey("secret", KeyVersionRaw, PurposeInfixMAC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(raw) != "secret" {
+		t.Errorf("raw key version produced %q", raw)
+	}
+	mac, err := subkey("secret", KeyVersionSubkeys, PurposeInfixMAC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encryption, err := subkey("secret", KeyVersionSubkeys, PurposeEncryption)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(mac) != 32 || bytes.Equal(mac, encryption) {
+		t.Error("subkeys for different purposes are not independent")
+	}
+}
+
+func TestSubkeyInvalid(t *testing.T) {
+	// both of these can come from a configuration file, so they must be reported rather than crash
+	if _, err := subkey("", KeyVersionSubkeys, PurposeInfixMAC); err == nil {
+		t.Error("empty secret key was accepted")
+	}
+	if _, err := subkey("secret", LatestKeyVersion+1, PurposeInfixMAC); err == nil {
+		t.Error("unknown key version was accepted")
+	}
+	if _, err := passphrase("", KeyVersionRaw); err == nil {
+		t.Error("empty passphrase was accepted")
+	}
+}
@@ -1,7 +1,10 @@
 package cryptapi
 
 import (
+	"bytes"
+	"crypto/sha256"
 	"errors"
+	"hash"
 	"io"
 	"io/ioutil"
 	"os"
@@ -67,3 +70,134 @@ type CombinedReadCloser struct {
 }
 
 var _ io.ReadCloser = CombinedReadCloser{}
+
+// multiCloser closes each of its members in order, collecting any errors.
+type multiCloser []io.Closer
+
+func (m multiCloser) Close() error {
+	var err error
+	for _, c := range m {
+		if err2 := c.Close(); err2 != nil {
+			err = multierror.Append(err, err2)
+		}
+	}
+	return err
+}
+
+// objects up to this size are buffered in memory rather than in a temporary file
+const memoryBufferLimit = 8 * 1024 * 1024
+
+// spillBuffer keeps written data in memory until it exceeds memoryBufferLimit, after which everything is moved into a
+// temporary file. The data is hashed as it is written, so that it only has to be read once more afterwards. This
+// bounds memory use, not latency: all of the data is held before any of it can be read back.
+type spillBuffer struct {
+	mem    bytes.Buffer
+	file   *bufferedFile
+	hasher hash.Hash
+	length int64
+}
+
+func newSpillBuffer() *spillBuffer {
+	return &spillBuffer{hasher: sha256.New()}
+}
+
+func (s *spillBuffer) Write(p []byte) (int, error) {
+	if s.file == nil && s.mem.Len()+len(p) > memoryBufferLimit {
+		f, err := ioutil.TempFile("", "spill-buffer")
+		if err != nil {
+			return 0, err
+		}
+		s.file = &bufferedFile{f: f}
+		if _, err := s.file.f.Write(s.mem.Bytes()); err != nil {
+			return 0, err
+		}
+		s.mem = bytes.Buffer{}
+	}
+	var n int
+	var err error
+	if s.file != nil {
+		n, err = s.file.f.Write(p)
+	} else {
+		n, err = s.mem.Write(p)
+	}
+	s.hasher.Write(p[:n])
+	s.length += int64(n)
+	return n, err
+}
+
+// Sum returns the SHA-256 hash of everything written so far.
+func (s *spillBuffer) Sum() []byte {
+	return s.hasher.Sum(nil)
+}
+
+func (s *spillBuffer) Len() int64 {
+	return s.length
+}
+
+// Contents returns a reader over everything written, which takes ownership of any temporary file.
+func (s *spillBuffer) Contents() (io.ReadSeekCloser, error) {
+	if s.file == nil {
+		return CombinedReadSeekCloser{ReadSeeker: bytes.NewReader(s.mem.Bytes()), Closer: nopCloser{}}, nil
+	}
+	if _, err := s.file.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	return s.file, nil
+}
+
+// Close discards the buffered data.
+func (s *spillBuffer) Close() error {
+	s.mem = bytes.Buffer{}
+	if s.file != nil {
+		return s.file.Close()
+	}
+	return nil
+}
+
+// BufferSpilling is like BufferInFile, but keeps small streams in memory. It is a bounded-memory buffer rather than a
+// stream: the whole input is read (up to memoryBufferLimit in memory, the rest in a temporary file) before it returns.
+// The temporary file is removed when the result is closed, or before returning if the input fails.
+func BufferSpilling(r io.Reader) (rc io.ReadSeekCloser, e error) {
+	s := newSpillBuffer()
+	if _, err := io.Copy(s, r); err != nil {
+		return nil, multierror.Append(err, s.Close())
+	}
+	contents, err := s.Contents()
+	if err != nil {
+		return nil, multierror.Append(err, s.Close())
+	}
+	return contents, nil
+}
+
+type CombinedReadSeekCloser struct {
+	io.ReadSeeker
+	io.Closer
+}
+
+type nopCloser struct{}
+
+func (nopCloser) Close() error {
+	return nil
+}
+
+// hashCheckedReader passes through decrypted data, but when the decrypted data ends, it consumes the rest of the
+// ciphertext and reports an error instead of EOF if the ciphertext did not match its expected hash. The data must
+// therefore be buffered until EOF has been reached, as getDecryptObjectStream does, before it is released.
+type hashCheckedReader struct {
+	plaintext  io.Reader
+	ciphertext io.Reader
+	check      func() error
+}
+
+func (h *hashCheckedReader) Read(p []byte) (int, error) {
+	n, err := h.plaintext.Read(p)
+	if err == io.EOF {
+		if _, err := io.Copy(io.Discard, h.ciphertext); err != nil {
+			return n, err
+		}
+		if err := h.check(); err != nil {
+			return n, err
+		}
+	}
+	return n, err
+}
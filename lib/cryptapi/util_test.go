@@ -0,0 +1,62 @@
+package cryptapi
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"testing"
+)
+
+// spilledFiles lists the temporary files that a spilling buffer has left behind.
+func spilledFiles(t *testing.T, dir string) []os.DirEntry {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return entries
+}
+
+func TestBufferSpillingRemovesFile(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("TMPDIR", dir)
+	data := bytes.Repeat([]byte("spill"), memoryBufferLimit/4)
+	buffered, err := BufferSpilling(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(spilledFiles(t, dir)) != 1 {
+		t.Error("large stream was not spilled into a temporary file")
+	}
+	read, err := io.ReadAll(buffered)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(read, data) {
+		t.Error("spilled data was not read back intact")
+	}
+	if err := buffered.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if files := spilledFiles(t, dir); len(files) != 0 {
+		t.Errorf("temporary file %q was not removed after success", files[0].Name())
+	}
+}
+
+func TestBufferSpillingRemovesFileOnHashMismatch(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("TMPDIR", dir)
+	mismatch := errors.New("hash did not match")
+	// the same reader that getDecryptObjectStream buffers, failing its check once the data has spilled to disk
+	plaintext := &hashCheckedReader{
+		plaintext:  bytes.NewReader(bytes.Repeat([]byte("spill"), memoryBufferLimit/4)),
+		ciphertext: bytes.NewReader(nil),
+		check:      func() error { return mismatch },
+	}
+	if _, err := BufferSpilling(plaintext); !errors.Is(err, mismatch) {
+		t.Fatalf("hash mismatch was not reported: %v", err)
+	}
+	if files := spilledFiles(t, dir); len(files) != 0 {
+		t.Errorf("temporary file %q was not removed after a hash mismatch", files[0].Name())
+	}
+}
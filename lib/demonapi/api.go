@@ -13,6 +13,7 @@ import (
 	"net/url"
 	"os"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/aws/aws-sdk-go/private/protocol/xml/xmlutil"
@@ -24,28 +25,74 @@ type ClerkConfig struct {
 	SpacePrefix string `json:"prefix"`
 	DeviceName  string `json:"device"`
 	DeviceToken string `json:"token"`
+	// if set, the device is known to the watchdemon server by this alias instead of by its name, so that its name does
+	// not appear in object paths; filled in by cryptapi from its device alias key
+	DeviceAlias string `json:"-"`
 }
 
 const (
-	ModeList = "List"
-	ModeGet  = "Get"
-	ModePut  = "Put"
+	ModeList         = "List"
+	ModeGet          = "Get"
+	ModePut          = "Put"
+	ModeCapabilities = "Capabilities"
 )
 
+// ProtocolVersion is the watchdemon protocol version spoken by this client.
+const ProtocolVersion = 2
+
+// MinServerProtocolVersion is the oldest watchdemon protocol version that this client can still use.
+const MinServerProtocolVersion = 1
+
+// the error reported by servers that predate the capabilities request
+const legacyModeError = "invalid request mode"
+
+// Capabilities describes a watchdemon deployment: the protocol versions it speaks, which checkCapabilities uses to
+// refuse incompatible servers, and its clock and presign window, which checkPresignExpiry uses to bound presigned URLs.
+type Capabilities struct {
+	Protocol       int   `json:"protocol"`
+	MinProtocol    int   `json:"min-protocol"`
+	ServerTimeMs   int64 `json:"server-time-ms"`
+	PresignSeconds int   `json:"presign-seconds"`
+	// how far ahead of our clock the server's clock is running; zero if the server did not report a time
+	ClockSkew time.Duration `json:"-"`
+}
+
+// legacyCapabilities describes a watchdemon deployment from before capabilities were reported.
+func legacyCapabilities() *Capabilities {
+	return &Capabilities{
+		Protocol:       1,
+		MinProtocol:    1,
+		PresignSeconds: 10,
+	}
+}
+
 type Clerk struct {
 	Client http.Client
 	Config ClerkConfig
+
+	capsLock sync.Mutex
+	caps     *Capabilities
 }
 
-func (c *Clerk) authenticate(mode, key, checksum string) (string, http.Header, string, error) {
+type remoteError struct {
+	StatusCode int
+	Status     string
+	Message    string
+}
+
+func (e *remoteError) Error() string {
+	return fmt.Sprintf("remote error (status %d %q): %q", e.StatusCode, e.Status, e.Message)
+}
+
+func (c *Clerk) request(mode, key, checksum string) (map[string]interface{}, error) {
 	if len(c.Config.URL) == 0 || len(c.Config.DeviceName) == 0 || len(c.Config.DeviceToken) == 0 || len(c.Config.SpacePrefix) == 0 {
-		return "", nil, "", errors.New("missing configuration")
+		return nil, errors.New("missing configuration")
 	}
 	if !strings.HasPrefix(c.Config.URL, "https://") {
-		return "", nil, "", errors.New("URL is not a valid HTTPS URL")
+		return nil, errors.New("URL is not a valid HTTPS URL")
 	}
 	values := url.Values{
-		"device": []string{c.Config.DeviceName},
+		"device": []string{c.DirectoryName()},
 		"token":  []string{c.Config.DeviceToken},
 		"mode":   []string{mode},
 		"key":    []string{key},
@@ -59,7 +106,7 @@ func (c *Clerk) authenticate(mode, key, checksum string) (string, http.Header, s
 		var err error
 		response, err = c.Client.PostForm(c.Config.URL+"/watchdemon/authenticate", values)
 		if err != nil {
-			return "", nil, "", err
+			return nil, err
 		}
 		if response.StatusCode == http.StatusTooManyRequests && backOff < time.Second*40 {
 			_ = response.Body.Close()
@@ -70,20 +117,100 @@ func (c *Clerk) authenticate(mode, key, checksum string) (string, http.Header, s
 		}
 	}
 	defer func() { _ = response.Body.Close() }()
+	replyData, err := readLimited(response.Body, maxReplySize, "watchdemon reply")
+	if err != nil {
+		return nil, err
+	}
 	var result map[string]interface{}
-	if err := json.NewDecoder(response.Body).Decode(&result); err != nil {
-		return "", nil, "", err
+	if err := json.Unmarshal(replyData, &result); err != nil {
+		return nil, err
 	}
 	if str, ok := result["error"].(string); ok {
-		return "", nil, "", fmt.Errorf("remote error (status %d %q): %q", response.StatusCode, response.Status, str)
+		return nil, &remoteError{StatusCode: response.StatusCode, Status: response.Status, Message: str}
+	}
+	return result, nil
+}
+
+func (c *Clerk) fetchCapabilities() (*Capabilities, error) {
+	sent := time.Now()
+	result, err := c.request(ModeCapabilities, "", "")
+	var re *remoteError
+	if errors.As(err, &re) && re.Message == legacyModeError {
+		return legacyCapabilities(), nil
+	} else if err != nil {
+		return nil, err
+	}
+	received := time.Now()
+	// round-trip through JSON to decode into the structure
+	encoded, err := json.Marshal(result)
+	if err != nil {
+		return nil, err
+	}
+	caps := &Capabilities{}
+	if err := json.Unmarshal(encoded, caps); err != nil {
+		return nil, err
+	}
+	if caps.Protocol < 1 || caps.PresignSeconds < 1 {
+		return nil, fmt.Errorf("invalid capabilities reported by server: %+v", *caps)
+	}
+	if caps.ServerTimeMs != 0 {
+		// assume the server sampled its clock halfway through the round trip
+		midpoint := sent.Add(received.Sub(sent) / 2)
+		caps.ClockSkew = time.UnixMilli(caps.ServerTimeMs).Sub(midpoint)
+	}
+	return caps, nil
+}
+
+func (c *Clerk) checkCapabilities(caps *Capabilities) error {
+	if caps.MinProtocol > ProtocolVersion {
+		return fmt.Errorf("watchdemon requires protocol version %d or newer, but this client only speaks version %d: "+
+			"upgrade nightmarket on this device", caps.MinProtocol, ProtocolVersion)
+	}
+	if caps.Protocol < MinServerProtocolVersion {
+		return fmt.Errorf("watchdemon only speaks protocol version %d, but this client requires version %d or newer: "+
+			"redeploy watchdemon from a newer nightmarket release", caps.Protocol, MinServerProtocolVersion)
+	}
+	skew := caps.ClockSkew
+	if skew < 0 {
+		skew = -skew
+	}
+	if window := time.Duration(caps.PresignSeconds) * time.Second; skew > window {
+		return fmt.Errorf("clock on this device differs from watchdemon by %v, which exceeds the %v presign window: "+
+			"synchronize the system clock", caps.ClockSkew.Round(time.Millisecond), window)
+	}
+	return nil
+}
+
+// Capabilities queries (and caches) the protocol version, clock, and presign window of the watchdemon server.
+func (c *Clerk) Capabilities() (*Capabilities, error) {
+	c.capsLock.Lock()
+	defer c.capsLock.Unlock()
+	if c.caps == nil {
+		caps, err := c.fetchCapabilities()
+		if err != nil {
+			return nil, err
+		}
+		if err := c.checkCapabilities(caps); err != nil {
+			return nil, err
+		}
+		c.caps = caps
+	}
+	return c.caps, nil
+}
+
+func (c *Clerk) authenticate(mode, key, checksum string) (string, http.Header, string, error) {
+	caps, err := c.Capabilities()
+	if err != nil {
+		return "", nil, "", err
+	}
+	result, err := c.request(mode, key, checksum)
+	if err != nil {
+		return "", nil, "", err
 	}
 	responseURL, ok := result["url"].(string)
 	if !ok {
 		return "", nil, "", errors.New("no URL returned in JSON object")
 	}
-	if !strings.HasPrefix(responseURL, c.Config.SpacePrefix) {
-		return "", nil, "", errors.New("presigned URL does not match expected pattern")
-	}
 	headersInterface, ok := result["headers"].(map[string]interface{})
 	headers := http.Header{}
 	if ok {
@@ -107,6 +234,12 @@ func (c *Clerk) authenticate(mode, key, checksum string) (string, http.Header, s
 		if !ok || len(createdFilename) == 0 {
 			return "", nil, "", errors.New("invalid created filename")
 		}
+	} else if _, found := result["created-filename"]; found {
+		return "", nil, "", errors.New("unexpected created filename")
+	}
+	err = c.validatePresigned(caps, mode, key, checksum, responseURL, headers, createdFilename)
+	if err != nil {
+		return "", nil, "", fmt.Errorf("rejected presigned %s request: %w", mode, err)
 	}
 	return responseURL, headers, createdFilename, nil
 }
@@ -151,7 +284,11 @@ func (c *Clerk) ListObjectsV2(continuationToken *string) (*s3.ListObjectsV2Outpu
 	if resp.StatusCode != 200 {
 		return nil, fmt.Errorf("invalid status code %d", resp.StatusCode)
 	}
-	decoder := xml.NewDecoder(resp.Body)
+	listing, err := readLimited(resp.Body, maxListingSize, "object listing")
+	if err != nil {
+		return nil, err
+	}
+	decoder := xml.NewDecoder(bytes.NewReader(listing))
 	result := &s3.ListObjectsV2Output{}
 	err = xmlutil.UnmarshalXML(result, decoder, "")
 	if err != nil {
@@ -178,6 +315,19 @@ func (c *Clerk) GetObject(path string) ([]byte, error) {
 
 func (c *Clerk) GetObjectStream(path string) (io.ReadCloser, error) {
 	defer timer("GetObjectStream")()
+	return c.getObjectInternal(path, "")
+}
+
+// GetObjectRange downloads at most the first length bytes of an object.
+func (c *Clerk) GetObjectRange(path string, length int64) (io.ReadCloser, error) {
+	defer timer("GetObjectRange")()
+	if length <= 0 {
+		return nil, errors.New("invalid range length")
+	}
+	return c.getObjectInternal(path, fmt.Sprintf("bytes=0-%d", length-1))
+}
+
+func (c *Clerk) getObjectInternal(path string, byteRange string) (io.ReadCloser, error) {
 	presignedURL, headers, _, err := c.authenticate(ModeGet, path, "")
 	if err != nil {
 		return nil, err
@@ -187,11 +337,16 @@ func (c *Clerk) GetObjectStream(path string) (io.ReadCloser, error) {
 		return nil, err
 	}
 	req.Header = headers
+	if byteRange != "" {
+		// not covered by the presigned signature, so it does not need to be requested from the watchdemon
+		req.Header.Set("Range", byteRange)
+	}
 	resp, err := c.Client.Do(req)
 	if err != nil {
 		return nil, err
 	}
-	if resp.StatusCode != 200 {
+	// a server may ignore the range and return the entire object
+	if resp.StatusCode != 200 && !(byteRange != "" && resp.StatusCode == 206) {
 		_ = resp.Body.Close()
 		return nil, fmt.Errorf("invalid status code %d", resp.StatusCode)
 	}
@@ -222,6 +377,13 @@ func (c *Clerk) PutObjectStream(pathInfix string, data io.ReadSeeker) (string, e
 	return c.putObjectInternal(pathInfix, hasher.Sum(nil), length, data)
 }
 
+// PutObjectHashed uploads data whose SHA-256 hash and length have already been computed by the caller, so that the
+// data only needs to be read once.
+func (c *Clerk) PutObjectHashed(pathInfix string, sha256sum []byte, length int64, data io.Reader) (string, error) {
+	defer timer("PutObjectHashed")()
+	return c.putObjectInternal(pathInfix, sha256sum, length, data)
+}
+
 func (c *Clerk) putObjectInternal(pathInfix string, sha256sum []byte, length int64, data io.Reader) (string, error) {
 	if len(sha256sum) != sha256.Size {
 		return "", errors.New("invalid hash")
@@ -257,3 +419,11 @@ func (c *Clerk) DeviceName() (string, error) {
 	}
 	return c.Config.DeviceName, nil
 }
+
+// DirectoryName returns the name that the watchdemon server knows this device by, which prefixes its object paths.
+func (c *Clerk) DirectoryName() string {
+	if c.Config.DeviceAlias != "" {
+		return c.Config.DeviceAlias
+	}
+	return c.Config.DeviceName
+}
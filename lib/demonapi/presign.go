@@ -0,0 +1,168 @@
+package demonapi
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// size limits on data returned by the watchdemon server and the storage provider
+const (
+	maxReplySize   = 64 * 1024
+	maxListingSize = 16 * 1024 * 1024
+)
+
+// maximum tolerated disagreement about the signing time of a presigned URL, beyond the measured clock skew
+const presignSlack = 5 * time.Second
+
+// readLimited reads the entire stream, but fails rather than truncating if more than limit bytes are available.
+func readLimited(r io.Reader, limit int64, what string) ([]byte, error) {
+	data, err := io.ReadAll(io.LimitReader(r, limit+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > limit {
+		return nil, fmt.Errorf("%s exceeded the size limit of %d bytes", what, limit)
+	}
+	return data, nil
+}
+
+// expectedSignedHeaders returns the headers that a presigned request for this mode must be signed over, in the sorted
+// lowercase form of X-Amz-SignedHeaders.
+func expectedSignedHeaders(mode string) string {
+	if mode == ModePut {
+		return "host;x-amz-content-sha256"
+	}
+	return "host"
+}
+
+// expectedObjectKey returns the key within the bucket that a presigned request for this mode must refer to, or "" if
+// the request should refer to the bucket itself.
+func (c *Clerk) expectedObjectKey(mode, key, checksum string) string {
+	switch mode {
+	case ModeGet:
+		return key
+	case ModePut:
+		return c.DirectoryName() + "/" + key + "#" + checksum
+	default:
+		return ""
+	}
+}
+
+func checkPresignExpiry(caps *Capabilities, query url.Values) error {
+	expires, err := strconv.ParseUint(query.Get("X-Amz-Expires"), 10, 32)
+	if err != nil {
+		return fmt.Errorf("invalid presigned expiry: %w", err)
+	}
+	window := time.Duration(caps.PresignSeconds) * time.Second
+	if expires == 0 || time.Duration(expires)*time.Second > window {
+		return fmt.Errorf("presigned expiry of %d seconds is outside the advertised %v window", expires, window)
+	}
+	signed, err := time.Parse("20060102T150405Z", query.Get("X-Amz-Date"))
+	if err != nil {
+		return fmt.Errorf("invalid presigned date: %w", err)
+	}
+	serverNow := time.Now().Add(caps.ClockSkew)
+	if signed.After(serverNow.Add(presignSlack)) {
+		return fmt.Errorf("presigned URL was signed in the future (%v)", signed)
+	}
+	if serverNow.After(signed.Add(time.Duration(expires)*time.Second + presignSlack)) {
+		return fmt.Errorf("presigned URL had already expired when received (signed at %v)", signed)
+	}
+	return nil
+}
+
+func checkPresignQuery(mode, key string, query url.Values) error {
+	for param, values := range query {
+		if strings.HasPrefix(param, "X-Amz-") {
+			if len(values) != 1 {
+				return fmt.Errorf("repeated presigned parameter %q", param)
+			}
+			continue
+		}
+		if mode == ModeList && param == "list-type" && len(values) == 1 && values[0] == "2" {
+			continue
+		}
+		if mode == ModeList && param == "continuation-token" && len(values) == 1 && values[0] == key && key != "" {
+			continue
+		}
+		return fmt.Errorf("unexpected parameter %q in presigned URL", param)
+	}
+	if mode == ModeList {
+		if query.Get("list-type") != "2" {
+			return errors.New("presigned listing URL is not a ListObjectsV2 request")
+		}
+		if query.Get("continuation-token") != key {
+			return errors.New("presigned listing URL does not carry the requested continuation token")
+		}
+	}
+	return nil
+}
+
+func checkPresignHeaders(mode, checksum string, query url.Values, headers http.Header) error {
+	if signed, want := query.Get("X-Amz-SignedHeaders"), expectedSignedHeaders(mode); signed != want {
+		return fmt.Errorf("presigned request is signed over headers %q instead of %q", signed, want)
+	}
+	for name, values := range headers {
+		if mode == ModePut && name == "X-Amz-Content-Sha256" && len(values) == 1 && values[0] == checksum {
+			continue
+		}
+		return fmt.Errorf("unexpected header %q in presigned request", name)
+	}
+	if mode == ModePut && headers.Get("X-Amz-Content-Sha256") != checksum {
+		return errors.New("presigned upload is not bound to the content checksum")
+	}
+	return nil
+}
+
+// validatePresigned makes sure that a presigned request returned by the watchdemon server refers to exactly the
+// object we requested, so that a compromised function cannot redirect us to a different object.
+func (c *Clerk) validatePresigned(caps *Capabilities, mode, key, checksum string,
+	presignedURL string, headers http.Header, createdFilename string) error {
+	space, err := url.Parse(c.Config.SpacePrefix)
+	if err != nil {
+		return err
+	}
+	u, err := url.Parse(presignedURL)
+	if err != nil {
+		return err
+	}
+	if u.Scheme != "https" || u.Opaque != "" || u.User != nil || u.Fragment != "" {
+		return fmt.Errorf("presigned URL %q is not a plain HTTPS URL", presignedURL)
+	}
+	if u.Host != space.Host {
+		return fmt.Errorf("presigned URL host %q does not match space host %q", u.Host, space.Host)
+	}
+	wantPath := strings.TrimSuffix(space.Path, "/") + "/" + c.expectedObjectKey(mode, key, checksum)
+	gotPath := u.Path
+	if mode == ModeList {
+		// path-style bucket URLs may omit the trailing slash when referring to the bucket itself
+		wantPath, gotPath = strings.TrimSuffix(wantPath, "/"), strings.TrimSuffix(gotPath, "/")
+	}
+	if gotPath != wantPath {
+		return fmt.Errorf("presigned URL path %q does not match expected path %q", u.Path, wantPath)
+	}
+	query := u.Query()
+	if err := checkPresignQuery(mode, key, query); err != nil {
+		return err
+	}
+	if err := checkPresignExpiry(caps, query); err != nil {
+		return err
+	}
+	if err := checkPresignHeaders(mode, checksum, query, headers); err != nil {
+		return err
+	}
+	if mode == ModePut {
+		if wantFilename := c.expectedObjectKey(mode, key, checksum); createdFilename != wantFilename {
+			return fmt.Errorf("created filename %q does not match expected filename %q", createdFilename, wantFilename)
+		}
+	} else if createdFilename != "" {
+		return errors.New("unexpected created filename for non-upload request")
+	}
+	return nil
+}
@@ -0,0 +1,134 @@
+package demonapi
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+const testChecksum = "a665a45920422f9d417e4867efdc4fb8a04a1f3fff1fa07e998e86f7f7a27ae3"
+
+func testClerk() *Clerk {
+	return &Clerk{Config: ClerkConfig{
+		URL:         "https://faas.example.com",
+		SpacePrefix: "https://space.nyc3.example.com/",
+		DeviceName:  "A",
+		DeviceToken: "token",
+	}}
+}
+
+var testCaps = &Capabilities{Protocol: ProtocolVersion, MinProtocol: 1, PresignSeconds: 10}
+
+// testPresign presigns a request in the same way that watchdemon does.
+func testPresign(t *testing.T, endpoint, mode, key string) (string, http.Header) {
+	spacesSession, err := session.NewSession(&aws.Config{
+		Credentials: credentials.NewStaticCredentials("access", "secret", ""),
+		Endpoint:    aws.String(endpoint),
+		Region:      aws.String("us-east-1"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	api := s3.New(spacesSession)
+	var req *request.Request
+	switch mode {
+	case ModeList:
+		input := &s3.ListObjectsV2Input{Bucket: aws.String("space")}
+		if key != "" {
+			input.ContinuationToken = aws.String(key)
+		}
+		req, _ = api.ListObjectsV2Request(input)
+	case ModeGet:
+		req, _ = api.GetObjectRequest(&s3.GetObjectInput{Bucket: aws.String("space"), Key: aws.String(key)})
+	case ModePut:
+		req, _ = api.PutObjectRequest(&s3.PutObjectInput{
+			Bucket: aws.String("space"),
+			Key:    aws.String("A/" + key + "#" + testChecksum),
+		})
+		req.HTTPRequest.Header.Set("X-Amz-Content-Sha256", testChecksum)
+	}
+	presignedURL, signedHeaders, err := req.PresignRequest(10 * time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// authenticate adds each header, which canonicalizes the lowercase names produced by the signer
+	headers := http.Header{}
+	for name, values := range signedHeaders {
+		for _, value := range values {
+			headers.Add(name, value)
+		}
+	}
+	return presignedURL, headers
+}
+
+func testCreatedFilename(mode, key string) string {
+	if mode == ModePut {
+		return "A/" + key + "#" + testChecksum
+	}
+	return ""
+}
+
+func TestValidatePresigned(t *testing.T) {
+	c := testClerk()
+	for _, test := range [][2]string{{ModeList, ""}, {ModeList, "token"}, {ModeGet, "A/object"}, {ModePut, "object"}} {
+		mode, key := test[0], test[1]
+		presignedURL, headers := testPresign(t, "https://nyc3.example.com", mode, key)
+		checksum := ""
+		if mode == ModePut {
+			checksum = testChecksum
+		}
+		err := c.validatePresigned(testCaps, mode, key, checksum, presignedURL, headers, testCreatedFilename(mode, key))
+		if err != nil {
+			t.Errorf("valid presigned %s request for %q was rejected: %v", mode, key, err)
+		}
+	}
+}
+
+func TestValidatePresignedWrongHost(t *testing.T) {
+	c := testClerk()
+	for _, mode := range []string{ModeList, ModeGet, ModePut} {
+		presignedURL, headers := testPresign(t, "https://nyc3.attacker.example.com", mode, "object")
+		checksum := ""
+		if mode == ModePut {
+			checksum = testChecksum
+		}
+		err := c.validatePresigned(testCaps, mode, "object", checksum, presignedURL, headers,
+			testCreatedFilename(mode, "object"))
+		if err == nil || !strings.Contains(err.Error(), "host") {
+			t.Errorf("presigned %s request for another host was not rejected: %v", mode, err)
+		}
+	}
+}
+
+func TestValidatePresignedSignedHeaders(t *testing.T) {
+	c := testClerk()
+	// an upload URL that was signed without binding the content checksum
+	presignedURL, _ := testPresign(t, "https://nyc3.example.com", ModeGet, "A/object#"+testChecksum)
+	headers := http.Header{"X-Amz-Content-Sha256": []string{testChecksum}}
+	err := c.validatePresigned(testCaps, ModePut, "object", testChecksum, presignedURL, headers,
+		testCreatedFilename(ModePut, "object"))
+	if err == nil || !strings.Contains(err.Error(), "signed over headers") {
+		t.Errorf("upload URL without a signed checksum was not rejected: %v", err)
+	}
+	// a download URL that was signed over an additional header
+	presignedURL, headers = testPresign(t, "https://nyc3.example.com", ModeGet, "A/object")
+	u, err := url.Parse(presignedURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	query := u.Query()
+	query.Set("X-Amz-SignedHeaders", "host;x-amz-content-sha256")
+	u.RawQuery = query.Encode()
+	err = c.validatePresigned(testCaps, ModeGet, "A/object", "", u.String(), headers, "")
+	if err == nil || !strings.Contains(err.Error(), "signed over headers") {
+		t.Errorf("download URL with extra signed headers was not rejected: %v", err)
+	}
+}
@@ -0,0 +1,143 @@
+package githelper
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+
+	"github.com/hashicorp/go-multierror"
+)
+
+// chainFeature is an optional pack feature: packs that have it record the hash of the previous pack from the same
+// device, so that packs which are withheld, reordered, or substituted can be detected.
+const chainFeature = "hash-chain"
+
+// chainHead is the latest verified pack in a device's hash chain.
+type chainHead struct {
+	Index uint64
+	// hex SHA-256 of the decrypted pack, which is unaffected by re-encryption
+	Hash string
+	// whether the device has started to link its packs, after which every pack it pushes must be linked
+	Linked bool
+}
+
+func (h *packHeader) isLinked() bool {
+	for _, feature := range h.Optional {
+		if feature == chainFeature {
+			return true
+		}
+	}
+	return false
+}
+
+// hashPack downloads a pack only to compute its hash, for packs merged before the refdb kept track of hashes.
+func (n *helper) hashPack(packPath string) (header *packHeader, hash string, err error) {
+	rc, err := n.Clerk.GetDecryptObjectStream(packPath)
+	if err != nil {
+		return nil, "", err
+	}
+	defer func() {
+		if err2 := rc.Close(); err2 != nil {
+			err = multierror.Append(err, err2)
+		}
+	}()
+	hasher := sha256.New()
+	buf := bufio.NewReader(io.TeeReader(rc, hasher))
+	headerBytes, err := buf.ReadBytes('\n')
+	if err != nil {
+		return nil, "", err
+	}
+	if header, err = parsePackHeader(packPath, headerBytes); err != nil {
+		return nil, "", err
+	}
+	if _, err := io.Copy(io.Discard, buf); err != nil {
+		return nil, "", err
+	}
+	return header, hex.EncodeToString(hasher.Sum(nil)), nil
+}
+
+// chainHead returns the head of a device's hash chain, or found=false if no packs from the device have been merged.
+func (n *helper) chainHead(device string) (head chainHead, found bool, err error) {
+	if head, found := n.RefDB.ChainHeads[device]; found {
+		return head, true, nil
+	}
+	var latestPath string
+	var latestIndex uint64
+	for _, pack := range n.RefDB.MergedPacks {
+		packDevice, infix, err := n.objectName(pack)
+		if err != nil {
+			return chainHead{}, false, err
+		}
+		_, deviceIndex, _, err := decodeInfix(infix)
+		if err != nil {
+			return chainHead{}, false, err
+		}
+		if packDevice == device && (latestPath == "" || deviceIndex > latestIndex) {
+			latestPath, latestIndex = pack, deviceIndex
+		}
+	}
+	if latestPath == "" {
+		return chainHead{}, false, nil
+	}
+	header, hash, err := n.hashPack(latestPath)
+	if err != nil {
+		return chainHead{}, false, err
+	}
+	head = chainHead{
+		Index:  latestIndex,
+		Hash:   hash,
+		Linked: header.isLinked(),
+	}
+	n.setChainHead(device, head)
+	return head, true, nil
+}
+
+func (n *helper) setChainHead(device string, head chainHead) {
+	if n.RefDB.ChainHeads == nil {
+		n.RefDB.ChainHeads = map[string]chainHead{}
+	}
+	n.RefDB.ChainHeads[device] = head
+}
+
+// verifyChain checks that a newly downloaded pack extends its device's hash chain, and returns the head that the chain
+// should be advanced to once the pack has been merged.
+func (n *helper) verifyChain(
+	packPath string, device string, deviceIndex uint64, header *packHeader, hash string,
+) (chainHead, error) {
+	head, found, err := n.chainHead(device)
+	if err != nil {
+		return chainHead{}, err
+	}
+	if !found && deviceIndex != 0 {
+		return chainHead{}, fmt.Errorf("security alert: pack %q is number %d from device %q, but no earlier packs "+
+			"from that device are present: the remote may be withholding them", packPath, deviceIndex, device)
+	}
+	if found && deviceIndex <= head.Index {
+		return chainHead{}, fmt.Errorf("security alert: pack %q is number %d from device %q, but pack %d was "+
+			"already merged: the device's history has forked", packPath, deviceIndex, device, head.Index)
+	}
+	if found && deviceIndex != head.Index+1 {
+		return chainHead{}, fmt.Errorf("security alert: pack %q is number %d from device %q, but the last merged "+
+			"pack was %d: the remote may be withholding packs", packPath, deviceIndex, device, head.Index)
+	}
+	if header.isLinked() {
+		var expected string
+		if found {
+			expected = head.Hash
+		}
+		if header.Previous != expected {
+			return chainHead{}, fmt.Errorf("security alert: pack %q from device %q does not follow the previously "+
+				"merged pack: the device's history has forked or been substituted", packPath, device)
+		}
+	} else if found && head.Linked {
+		return chainHead{}, fmt.Errorf("security alert: pack %q from device %q is not linked to the previous "+
+			"pack, even though the device links its packs", packPath, device)
+	}
+	return chainHead{
+		Index:  deviceIndex,
+		Hash:   hash,
+		Linked: header.isLinked(),
+	}, nil
+}
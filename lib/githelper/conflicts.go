@@ -0,0 +1,216 @@
+package githelper
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+)
+
+// disputed refs are published under latest/ as refs/<namespace>/latest/conflicts/<rest>/<device>, one per device
+const conflictsPrefix = "conflicts/"
+
+// ConflictReport is written into the git directory whenever the refs of a remote are listed, so that disputes can be
+// examined without having to compare the device refs by hand.
+type ConflictReport struct {
+	Remote    string     `json:"remote"`
+	Conflicts []Conflict `json:"conflicts"`
+}
+
+type Conflict struct {
+	// the full name of the disputed ref, such as refs/heads/main
+	Ref string `json:"ref"`
+	// the pack that introduced the newest of the competing values, or empty if unknown
+	Since   string         `json:"since,omitempty"`
+	Devices []ConflictHead `json:"devices"`
+}
+
+type ConflictHead struct {
+	Device string `json:"device"`
+	Sha1   string `json:"sha1"`
+	// the pack in which the device set the ref to this value, or empty if unknown
+	Pack string `json:"pack,omitempty"`
+	// the remote ref under which this value is published
+	RemoteRef string `json:"remote-ref"`
+}
+
+func conflictReportPath(gitDir, remote string) string {
+	return path.Join(gitDir, fmt.Sprintf("nightmarket-%s-conflicts.json", remote))
+}
+
+// ReadConflictReport returns the conflict report written during the last listing of a remote, or nil if the remote
+// has never been listed.
+func ReadConflictReport(gitDir, remote string) (*ConflictReport, error) {
+	data, err := ioutil.ReadFile(conflictReportPath(gitDir, remote))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	report := &ConflictReport{}
+	if err := json.Unmarshal(data, report); err != nil {
+		return nil, err
+	}
+	return report, nil
+}
+
+func (n *helper) writeConflictReport(conflicts []Conflict) error {
+	sort.Slice(conflicts, func(i, j int) bool {
+		return conflicts[i].Ref < conflicts[j].Ref
+	})
+	if conflicts == nil {
+		conflicts = []Conflict{}
+	}
+	data, err := json.MarshalIndent(ConflictReport{
+		Remote:    n.Remote,
+		Conflicts: conflicts,
+	}, "", "  ")
+	if err != nil {
+		return err
+	}
+	reportPath := conflictReportPath(n.GitDir, n.Remote)
+	if err := ioutil.WriteFile(reportPath+".temp", append(data, '\n'), 0666); err != nil {
+		return err
+	}
+	return os.Rename(reportPath+".temp", reportPath)
+}
+
+// conflictRefName returns the name under which a device's value of a disputed ref is published.
+func conflictRefName(name, device string) (string, error) {
+	parts := strings.SplitN(name, "/", 3)
+	if len(parts) != 3 || parts[0] != "refs" {
+		return "", fmt.Errorf("invalid ref name: %q", name)
+	}
+	return "refs/" + parts[1] + "/" + conflictsPrefix + parts[2] + "/" + device, nil
+}
+
+// decodeConflictRefName reverses conflictRefName, and returns ok=false if the name is not a conflict ref.
+func decodeConflictRefName(name string) (original, device string, ok bool) {
+	parts := strings.SplitN(name, "/", 3)
+	if len(parts) != 3 || parts[0] != "refs" || !strings.HasPrefix(parts[2], conflictsPrefix) {
+		return "", "", false
+	}
+	rest := parts[2][len(conflictsPrefix):]
+	split := strings.LastIndex(rest, "/")
+	if split <= 0 || split == len(rest)-1 {
+		return "", "", false
+	}
+	return "refs/" + parts[1] + "/" + rest[:split], rest[split+1:], true
+}
+
+// rememberOrigin records the pack in which a device set a ref, so that conflicts can report when they began.
+func (rf *refDBState) rememberOrigin(device, name, pack string) {
+	if rf.RefOrigins == nil {
+		rf.RefOrigins = map[string]map[string]string{}
+	}
+	if rf.RefOrigins[device] == nil {
+		rf.RefOrigins[device] = map[string]string{}
+	}
+	rf.RefOrigins[device][name] = pack
+}
+
+// disputeHeads returns the devices whose values of a disputed ref are not contained in any other device's value.
+func (n *helper) disputeHeads(name string, devices, sha1s []string) ([]string, error) {
+	// tags are disputed whenever they differ, so every value is a competitor
+	if strings.HasPrefix(name, "refs/tags/") {
+		return devices, nil
+	}
+	var heads []string
+	for i, sha1 := range sha1s {
+		superseded := false
+		for j, other := range sha1s {
+			if i == j || other == sha1 {
+				continue
+			}
+			contained, err := n.containsCommit(other, sha1)
+			if err != nil {
+				return nil, err
+			}
+			if contained {
+				superseded = true
+				break
+			}
+		}
+		if !superseded {
+			heads = append(heads, devices[i])
+		}
+	}
+	return heads, nil
+}
+
+// containsCommit returns true if descendant is a commit whose history includes the commit ancestor.
+func (n *helper) containsCommit(descendant, ancestor string) (bool, error) {
+	for _, sha1 := range []string{descendant, ancestor} {
+		objectType, err := n.gitObjectType(sha1)
+		if err != nil {
+			return false, err
+		}
+		if objectType != "commit" {
+			return false, nil
+		}
+	}
+	return n.gitIsAncestor(ancestor, descendant)
+}
+
+// describeConflict publishes each device's value of a disputed ref, and describes the dispute for the report.
+func (n *helper) describeConflict(name string, devices, sha1s []string) (Conflict, error) {
+	heads, err := n.disputeHeads(name, devices, sha1s)
+	if err != nil {
+		return Conflict{}, err
+	}
+	allRefs := n.RefDB.deviceRefs()
+	conflict := Conflict{Ref: name}
+	var sinceIndex uint64
+	for _, device := range heads {
+		conflictName, err := conflictRefName(name, device)
+		if err != nil {
+			return Conflict{}, err
+		}
+		remoteRef, err := encodeRemoteRef(mergeDevice, conflictName)
+		if err != nil {
+			return Conflict{}, err
+		}
+		pack := n.RefDB.RefOrigins[device][name]
+		conflict.Devices = append(conflict.Devices, ConflictHead{
+			Device:    device,
+			Sha1:      allRefs[device][name],
+			Pack:      pack,
+			RemoteRef: remoteRef,
+		})
+		if pack == "" {
+			continue
+		}
+		_, globalIndex, err := decodePackName(pack)
+		if err != nil {
+			return Conflict{}, err
+		}
+		if conflict.Since == "" || globalIndex > sinceIndex {
+			conflict.Since, sinceIndex = pack, globalIndex
+		}
+	}
+	sort.Slice(conflict.Devices, func(i, j int) bool {
+		return conflict.Devices[i].Device < conflict.Devices[j].Device
+	})
+	return conflict, nil
+}
+
+// decodePackName extracts the indexes from a readable pack name of the form <device>/push-<device>-<global>.
+func decodePackName(pack string) (deviceIndex, globalIndex uint64, err error) {
+	parts := strings.SplitN(pack, "/", 2)
+	if len(parts) != 2 {
+		return 0, 0, fmt.Errorf("invalid pack name %q", pack)
+	}
+	isPush, deviceIndex, globalIndex, err := decodeInfix(parts[1])
+	if err != nil {
+		return 0, 0, err
+	}
+	if !isPush {
+		return 0, 0, fmt.Errorf("invalid pack name %q", pack)
+	}
+	return deviceIndex, globalIndex, nil
+}
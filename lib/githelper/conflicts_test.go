@@ -0,0 +1,44 @@
+package githelper
+
+import "testing"
+
+func TestConflictRefNameRoundTrip(t *testing.T) {
+	for _, test := range []struct {
+		name, device, ref string
+	}{
+		{"refs/heads/main", "A", "refs/heads/conflicts/main/A"},
+		{"refs/heads/feature/x", "B", "refs/heads/conflicts/feature/x/B"},
+		{"refs/tags/v1.0", "A", "refs/tags/conflicts/v1.0/A"},
+	} {
+		ref, err := conflictRefName(test.name, test.device)
+		if err != nil {
+			t.Errorf("conflictRefName(%q, %q): %v", test.name, test.device, err)
+		} else if ref != test.ref {
+			t.Errorf("conflictRefName(%q, %q) = %q, expected %q", test.name, test.device, ref, test.ref)
+		}
+		name, device, ok := decodeConflictRefName(test.ref)
+		if !ok || name != test.name || device != test.device {
+			t.Errorf("decodeConflictRefName(%q) = %q, %q, %v, expected %q, %q", test.ref, name, device, ok,
+				test.name, test.device)
+		}
+	}
+}
+
+func TestConflictRefNameInvalid(t *testing.T) {
+	for _, ref := range []string{
+		"",
+		"HEAD",
+		"refs/heads/main",
+		"refs/tags/v1.0",
+		"heads/conflicts/main/A",
+		"refs/heads/conflicts/main/",
+		"refs/heads/conflicts/x",
+	} {
+		if name, device, ok := decodeConflictRefName(ref); ok {
+			t.Errorf("decodeConflictRefName(%q) = %q, %q, expected not to be a conflict ref", ref, name, device)
+		}
+	}
+	if ref, err := conflictRefName("HEAD", "A"); err == nil {
+		t.Errorf("conflictRefName(HEAD, A) = %q, expected an error", ref)
+	}
+}
@@ -2,6 +2,8 @@ package githelper
 
 import (
 	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -17,6 +19,7 @@ import (
 
 	"github.com/celskeggs/nightmarket/lib/cryptapi"
 	"github.com/celskeggs/nightmarket/lib/gitremote"
+	"github.com/celskeggs/nightmarket/lib/util"
 	"github.com/hashicorp/go-multierror"
 )
 
@@ -24,7 +27,24 @@ const mergeDevice = "latest"
 const branchPrefix = "refs/heads/"
 const specialAnnexPrefix = "synced/"
 const specialAnnexPath = "synced/git-annex"
-const version = 1
+
+// pack format versions. Packs only use versionFeatures when they require a feature, so that packs which only push
+// branches remain readable by clients that predate features.
+const (
+	versionPlain    = 1
+	versionFeatures = 2
+	version         = versionFeatures
+)
+
+// required pack features: packs that have them carry refs outside of refs/heads/, or tombstones for deleted refs,
+// which older clients would otherwise silently drop.
+const (
+	refsFeature    = "refs"
+	deletedFeature = "deleted-refs"
+)
+
+// packFeatures lists the required features that this client understands.
+var packFeatures = []string{refsFeature, deletedFeature}
 
 func decodePseudoRef(ref string) (device, branch string, err error) {
 	if err := gitremote.PartiallyValidateRefName(ref); err != nil {
@@ -73,6 +93,44 @@ func encodePseudoRef(device, branch string) (string, error) {
 	return branchPrefix + device + "/" + branch, nil
 }
 
+// decodeRemoteRef is like decodePseudoRef, but also accepts refs outside of refs/heads/, which are scoped by device
+// after their first component; for example, refs/tags/<device>/v1.0 is the tag refs/tags/v1.0 pushed by <device>.
+// The returned ref is the full name of the ref as it exists on the device.
+func decodeRemoteRef(ref string) (device, name string, err error) {
+	if strings.HasPrefix(ref, branchPrefix) {
+		device, branch, err := decodePseudoRef(ref)
+		if err != nil {
+			return "", "", err
+		}
+		return device, branchPrefix + branch, nil
+	}
+	if err := gitremote.PartiallyValidateRefName(ref); err != nil {
+		return "", "", err
+	}
+	parts := strings.SplitN(ref, "/", 4)
+	if len(parts) != 4 || parts[0] != "refs" || parts[1] == "" || parts[2] == "" || parts[3] == "" {
+		return "", "", fmt.Errorf("invalid remote ref: %q", ref)
+	}
+	return parts[2], "refs/" + parts[1] + "/" + parts[3], nil
+}
+
+func encodeRemoteRef(device, name string) (string, error) {
+	if strings.HasPrefix(name, branchPrefix) {
+		return encodePseudoRef(device, name[len(branchPrefix):])
+	}
+	if err := gitremote.PartiallyValidateRefName(device); err != nil {
+		return "", err
+	}
+	if strings.Contains(device, "/") {
+		return "", fmt.Errorf("invalid device name: %q", device)
+	}
+	parts := strings.SplitN(name, "/", 3)
+	if len(parts) != 3 || parts[0] != "refs" || parts[1] == "" || parts[2] == "" {
+		return "", fmt.Errorf("invalid ref name: %q", name)
+	}
+	return "refs/" + parts[1] + "/" + device + "/" + parts[2], nil
+}
+
 // decodeInfix will return valid=false if the infix indicates it's not a push (such as if it's a file stored in the
 // git-annex special remote.)
 func decodeInfix(infix string) (valid bool, deviceIndex, globalIndex uint64, err error) {
@@ -102,13 +160,58 @@ type packHeader struct {
 	Version int `json:"version"`
 	// branch -> sha1
 	Branches map[string]string `json:"branches"`
+	// full ref name -> sha1, for refs outside of refs/heads/ (such as tags and notes)
+	Refs map[string]string `json:"refs,omitempty"`
+	// full ref name -> sha1 that the ref pointed to when it was deleted
+	Deleted map[string]string `json:"deleted,omitempty"`
+	// hex SHA-256 of the previous pack from the same device, if any; see chainFeature
+	Previous string `json:"previous,omitempty"`
+	util.Compatibility
 }
 
 type refDBState struct {
 	// device -> (branch -> sha1)
 	DeviceBranches map[string]map[string]string
+	// device -> (full ref name -> sha1), for refs outside of refs/heads/
+	DeviceRefs map[string]map[string]string
+	// device -> (full ref name -> sha1 at deletion), for refs deleted by that device
+	Tombstones map[string]map[string]string
+	// device -> (full ref name -> readable name of the pack that last set or deleted it)
+	RefOrigins map[string]map[string]string
 	// list of filenames that have already been downloaded and unpacked
 	MergedPacks []string
+	// filename -> readable infix, for objects stored under opaque infixes that are not sealed
+	ObjectNames map[string]string
+	// device -> latest verified pack from that device
+	ChainHeads map[string]chainHead
+	// the serial of the newest policy seen, so that older policies cannot be substituted
+	PolicySerial uint64
+}
+
+// deviceRefs returns every ref known for each device, keyed by full ref name, including branches.
+func (rf *refDBState) deviceRefs() map[string]map[string]string {
+	all := map[string]map[string]string{}
+	for device, branches := range rf.DeviceBranches {
+		all[device] = map[string]string{}
+		for branch, sha1 := range branches {
+			all[device][branchPrefix+branch] = sha1
+		}
+	}
+	for device, refs := range rf.DeviceRefs {
+		if all[device] == nil {
+			all[device] = map[string]string{}
+		}
+		for name, sha1 := range refs {
+			all[device][name] = sha1
+		}
+	}
+	return all
+}
+
+// clearTombstone forgets a device's own deletion of a ref, because the device has pushed it again since then. Other
+// devices' deletions are kept, and isBuried decides whether they still apply to the new value.
+func (rf *refDBState) clearTombstone(device, name string) {
+	delete(rf.Tombstones[device], name)
 }
 
 type helper struct {
@@ -116,6 +219,13 @@ type helper struct {
 	GitDir string
 	Remote string
 	RefDB  *refDBState
+	// options set by git; see SetOption
+	Verbosity int
+	Progress  bool
+	DryRun    bool
+	Atomic    bool
+	// remote ref -> expected sha1, or an empty string if the ref is expected not to exist; see addLease
+	Leases map[string]string
 }
 
 func Init(remote string, configPath string) (gitremote.Helper, error) {
@@ -136,6 +246,8 @@ func Init(remote string, configPath string) (gitremote.Helper, error) {
 		GitDir: gitDir,
 		Remote: remote,
 		RefDB:  nil,
+		// git only sends the verbosity if it differs from the default
+		Verbosity: levelInfo,
 	}
 	return nm, nil
 }
@@ -190,26 +302,114 @@ func (n *helper) saveRefDB() error {
 
 type void struct{}
 
+func (n *helper) rememberName(objectPath, name string) {
+	if n.RefDB.ObjectNames == nil {
+		n.RefDB.ObjectNames = map[string]string{}
+	}
+	n.RefDB.ObjectNames[objectPath] = name
+}
+
+// objectName returns the device and readable infix of an object. The names behind sealed infixes are recovered
+// locally, but older opaque infixes must already have been examined by learnNames.
+func (n *helper) objectName(objectPath string) (device, name string, err error) {
+	_, infix, _, err := cryptapi.SplitPath(objectPath)
+	if err != nil {
+		return "", "", err
+	}
+	if device, err = n.Clerk.PathDevice(objectPath); err != nil {
+		return "", "", err
+	}
+	if !cryptapi.IsOpaqueInfix(infix) {
+		return device, infix, nil
+	}
+	if cryptapi.IsSealedInfix(infix) {
+		name, err = n.Clerk.ObjectName(objectPath)
+		return device, name, err
+	}
+	name, found := n.RefDB.ObjectNames[objectPath]
+	if !found {
+		return "", "", fmt.Errorf("no name known for opaque object %q", objectPath)
+	}
+	return device, name, nil
+}
+
+// learnNames decrypts the headers of any objects with older opaque infixes whose names are not yet known. The names
+// are kept in the refdb, so that each object only needs to be examined once; sealed infixes never need examining.
+func (n *helper) learnNames(objects []string) error {
+	var learned bool
+	for _, object := range objects {
+		_, infix, _, err := cryptapi.SplitPath(object)
+		if err != nil {
+			return err
+		}
+		if _, found := n.RefDB.ObjectNames[object]; found || !cryptapi.IsOpaqueInfix(infix) ||
+			cryptapi.IsSealedInfix(infix) {
+			continue
+		}
+		name, err := n.Clerk.ObjectName(object)
+		if err != nil {
+			return err
+		}
+		n.rememberName(object, name)
+		learned = true
+	}
+	if learned {
+		return n.saveRefDB()
+	}
+	return nil
+}
+
 func (n *helper) listDownloads() ([]string, error) {
 	objects, err := n.Clerk.ListObjects()
 	if err != nil {
 		return nil, err
 	}
+	if err := n.learnNames(objects); err != nil {
+		return nil, err
+	}
 	toDownload := map[string]void{}
+	// device/infix -> paths, so that packs re-encrypted by a rekey can be matched to their originals
+	byInfix := map[string][]string{}
 	for _, object := range objects {
 		toDownload[object] = void{}
+		device, infix, err := n.objectName(object)
+		if err != nil {
+			return nil, err
+		}
+		byInfix[device+"/"+infix] = append(byInfix[device+"/"+infix], object)
 	}
-	for _, pack := range n.RefDB.MergedPacks {
+	var replaced bool
+	for i, pack := range n.RefDB.MergedPacks {
+		device, infix, err := n.objectName(pack)
+		if err != nil {
+			return nil, err
+		}
 		if _, found := toDownload[pack]; !found {
-			return nil, fmt.Errorf("the pack %q that we previously downloaded is gone", pack)
+			candidates := byInfix[device+"/"+infix]
+			if len(candidates) != 1 {
+				return nil, fmt.Errorf("security alert: the pack %q that we previously downloaded is gone: the "+
+					"remote may have been rolled back", pack)
+			}
+			// the same pack was re-encrypted under a new key; there's no need to download it again
+			n.logf(levelInfo, "pack %q was replaced by %q", pack, candidates[0])
+			n.RefDB.MergedPacks[i] = candidates[0]
+			replaced = true
+		}
+		// any other copies of a merged pack (such as during a rekey) must not be applied a second time
+		for _, copied := range byInfix[device+"/"+infix] {
+			delete(toDownload, copied)
+		}
+	}
+	if replaced {
+		if err := n.saveRefDB(); err != nil {
+			return nil, err
 		}
-		delete(toDownload, pack)
 	}
 	var orderedDownloads []string
 	indexLookup := map[string]uint64{}
 	for download := range toDownload {
 		// validate that infix can be extracted
-		_, infix, _, err := cryptapi.SplitPath(download)
+		_, infix, err := n.objectName(download)
 		if err != nil {
 			return nil, err
 		}
@@ -234,8 +434,37 @@ func (n *helper) listDownloads() ([]string, error) {
 	return orderedDownloads, nil
 }
 
-func (n *helper) downloadAndUnpack(packPath string) (h *packHeader, err error) {
-	_, _ = fmt.Fprintf(os.Stderr, "nightmarket: downloading and unpacking %q\n", packPath)
+// require marks the pack as unreadable by clients that do not understand the feature. Clients from before features
+// only check the version, so it is raised for them as well.
+func (h *packHeader) require(feature string) {
+	h.Version = versionFeatures
+	h.Required = append(h.Required, feature)
+}
+
+// parsePackHeader decodes the JSON header line of a pack, and checks that this client can read the rest of the pack.
+func parsePackHeader(packPath string, headerBytes []byte) (*packHeader, error) {
+	var header packHeader
+	if err := json.Unmarshal(headerBytes, &header); err != nil {
+		return nil, err
+	}
+	reader := util.FormatReader{
+		Name:     fmt.Sprintf("pack %q", packPath),
+		Oldest:   versionPlain,
+		Newest:   version,
+		Features: packFeatures,
+	}
+	if err := reader.Check(header.Version, header.Compatibility); err != nil {
+		return nil, err
+	}
+	return &header, nil
+}
+
+// downloadAndUnpack downloads a pack and checks that it extends its device's hash chain before unpacking it. The hash
+// covers the whole pack, so the pack is buffered (in memory, or in a temporary file if it is large) until the chain has
+// been checked, and nothing from a pack that fails the check reaches the repository.
+func (n *helper) downloadAndUnpack(
+	packPath, device string, deviceIndex uint64, position, total int,
+) (h *packHeader, err error) {
 	rc, err := n.Clerk.GetDecryptObjectStream(packPath)
 	if err != nil {
 		return nil, err
@@ -245,18 +474,42 @@ func (n *helper) downloadAndUnpack(packPath string) (h *packHeader, err error) {
 			err = multierror.Append(err, err2)
 		}
 	}()
+	var source io.Reader = rc
+	var progress *progressReader
+	if n.Progress {
+		progress = &progressReader{r: rc, label: fmt.Sprintf("receiving pack %d/%d", position, total)}
+		source = progress
+		n.logf(levelVerbose, "downloading and unpacking %q", packPath)
+	} else {
+		n.logf(levelInfo, "downloading and unpacking %q", packPath)
+	}
+	// hash the whole pack, including its header, for the device's hash chain
+	hasher := sha256.New()
+	buffered, err := cryptapi.BufferSpilling(io.TeeReader(source, hasher))
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err2 := buffered.Close(); err2 != nil {
+			err = multierror.Append(err, err2)
+		}
+	}()
+	if progress != nil {
+		progress.Done()
+	}
 	// use a buffered reader to strip off the first line (which contains the JSON header)
-	buf := bufio.NewReader(rc)
+	buf := bufio.NewReader(buffered)
 	headerBytes, err := buf.ReadBytes('\n')
 	if err != nil {
 		return nil, err
 	}
-	var header packHeader
-	if err = json.Unmarshal(headerBytes, &header); err != nil {
+	header, err := parsePackHeader(packPath, headerBytes)
+	if err != nil {
 		return nil, err
 	}
-	if header.Version != version {
-		return nil, fmt.Errorf("version mismatch: %d instead of %d", header.Version, version)
+	head, err := n.verifyChain(packPath, device, deviceIndex, header, hex.EncodeToString(hasher.Sum(nil)))
+	if err != nil {
+		return nil, err
 	}
 	// now feed the rest of the file after the header into git unpack-objects
 	cmd := exec.Command("git", "unpack-objects", "-q")
@@ -268,7 +521,8 @@ func (n *helper) downloadAndUnpack(packPath string) (h *packHeader, err error) {
 	if len(output) != 0 {
 		return nil, fmt.Errorf("unexpected output from unpack-objects: %q", string(output))
 	}
-	return &header, nil
+	n.setChainHead(device, head)
+	return header, nil
 }
 
 func (n *helper) gitObjectType(sha1 string) (string, error) {
@@ -310,12 +564,56 @@ func (n *helper) updateFromHeader(device string, packPath string, header *packHe
 		return errors.New("invalid device name")
 	}
 	rf.MergedPacks = append(rf.MergedPacks, packPath)
+	_, infix, err := n.objectName(packPath)
+	if err != nil {
+		return err
+	}
+	pack := device + "/" + infix
 	if rf.DeviceBranches[device] == nil {
 		rf.DeviceBranches[device] = map[string]string{}
 	}
 	branches := rf.DeviceBranches[device]
 	for branch, sha1 := range header.Branches {
 		branches[branch] = sha1
+		rf.clearTombstone(device, branchPrefix+branch)
+		rf.rememberOrigin(device, branchPrefix+branch, pack)
+	}
+	if len(header.Refs) > 0 {
+		if rf.DeviceRefs == nil {
+			rf.DeviceRefs = map[string]map[string]string{}
+		}
+		if rf.DeviceRefs[device] == nil {
+			rf.DeviceRefs[device] = map[string]string{}
+		}
+		for name, sha1 := range header.Refs {
+			// branches must only be carried in the branches list
+			if _, err := encodeRemoteRef(device, name); err != nil || strings.HasPrefix(name, branchPrefix) {
+				n.logf(levelWarning, "ignoring invalid ref %q in pack %q", name, packPath)
+				continue
+			}
+			rf.DeviceRefs[device][name] = sha1
+			rf.clearTombstone(device, name)
+			rf.rememberOrigin(device, name, pack)
+		}
+	}
+	for name, sha1 := range header.Deleted {
+		if _, err := encodeRemoteRef(device, name); err != nil {
+			n.logf(levelWarning, "ignoring invalid deleted ref %q in pack %q", name, packPath)
+			continue
+		}
+		if strings.HasPrefix(name, branchPrefix) {
+			delete(branches, name[len(branchPrefix):])
+		} else {
+			delete(rf.DeviceRefs[device], name)
+		}
+		if rf.Tombstones == nil {
+			rf.Tombstones = map[string]map[string]string{}
+		}
+		if rf.Tombstones[device] == nil {
+			rf.Tombstones[device] = map[string]string{}
+		}
+		rf.Tombstones[device][name] = sha1
+		rf.rememberOrigin(device, name, pack)
 	}
 	if err := n.saveRefDB(); err != nil {
 		return err
@@ -326,7 +624,7 @@ func (n *helper) updateFromHeader(device string, packPath string, header *packHe
 func (n *helper) synch() error {
 	err := n.loadRefDB()
 	if errors.Is(err, fs.ErrNotExist) {
-		_, _ = fmt.Fprintf(os.Stderr, "nightmarket: initializing new local refdb\n")
+		n.logf(levelInfo, "initializing new local refdb")
 		n.RefDB = &refDBState{
 			DeviceBranches: map[string]map[string]string{},
 			MergedPacks:    nil,
@@ -334,16 +632,24 @@ func (n *helper) synch() error {
 	} else if err != nil {
 		return err
 	}
+	if err := n.loadPolicy(); err != nil {
+		return err
+	}
 	toDownload, err := n.listDownloads()
 	if err != nil {
 		return err
 	}
-	for _, packPath := range toDownload {
-		device, _, _, err := cryptapi.SplitPath(packPath)
+	n.logf(levelVerbose, "%d new packs to download", len(toDownload))
+	for i, packPath := range toDownload {
+		device, infix, err := n.objectName(packPath)
 		if err != nil {
 			return err
 		}
-		header, err := n.downloadAndUnpack(packPath)
+		_, deviceIndex, _, err := decodeInfix(infix)
+		if err != nil {
+			return err
+		}
+		header, err := n.downloadAndUnpack(packPath, device, deviceIndex, i+1, len(toDownload))
 		if err != nil {
 			return err
 		}
@@ -352,11 +658,144 @@ func (n *helper) synch() error {
 		}
 	}
 	if len(n.RefDB.MergedPacks) == 0 {
-		_, _ = fmt.Fprintf(os.Stderr, "nightmarket: remote is empty; ignoring\n")
+		n.logf(levelInfo, "remote is empty; ignoring")
+	}
+	return nil
+}
+
+// loadPolicy loads the space's policy, which must not have been rolled back or removed since it was last seen.
+func (n *helper) loadPolicy() error {
+	serial, err := n.Clerk.LoadPolicy(n.RefDB.PolicySerial)
+	if err != nil {
+		return err
+	}
+	if serial > n.RefDB.PolicySerial {
+		n.RefDB.PolicySerial = serial
+		return n.saveRefDB()
 	}
 	return nil
 }
 
+// isBuried returns true if a device's value for a ref is made obsolete by another device's deletion of that ref: that
+// is, if the deleted value was the same as this value, or contained it in its history. A deletion does not apply if the
+// device set the ref after having seen it, because the device re-created the ref.
+func (n *helper) isBuried(device, name, sha1 string) (bool, error) {
+	for deleter, tombstones := range n.RefDB.Tombstones {
+		deleted, found := tombstones[name]
+		if !found {
+			continue
+		}
+		if recreated, err := n.setSince(device, deleter, name); err != nil {
+			return false, err
+		} else if recreated {
+			continue
+		}
+		if deleted == sha1 {
+			return true, nil
+		}
+		deletedType, err := n.gitObjectType(deleted)
+		if err != nil {
+			return false, err
+		}
+		currentType, err := n.gitObjectType(sha1)
+		if err != nil {
+			return false, err
+		}
+		if deletedType != "commit" || currentType != "commit" {
+			continue
+		}
+		if isAncestor, err := n.gitIsAncestor(sha1, deleted); err != nil {
+			return false, err
+		} else if isAncestor {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// setSince returns true if device set a ref in a pack that was pushed after the pack in which deleter deleted it. Pack
+// global indexes always exceed those of every pack that the pushing device had seen, so they order the two.
+func (n *helper) setSince(device, deleter, name string) (bool, error) {
+	setPack, deletePack := n.RefDB.RefOrigins[device][name], n.RefDB.RefOrigins[deleter][name]
+	if setPack == "" || deletePack == "" {
+		return false, nil
+	}
+	_, setIndex, err := decodePackName(setPack)
+	if err != nil {
+		return false, err
+	}
+	_, deleteIndex, err := decodePackName(deletePack)
+	if err != nil {
+		return false, err
+	}
+	return setIndex > deleteIndex, nil
+}
+
+// listedValue returns the value that List reports for a device's ref, or for the merged ref if the device is the merge
+// device, or an empty string if the ref is not listed.
+func (n *helper) listedValue(device, name string) (string, error) {
+	if device != mergeDevice {
+		return n.RefDB.deviceRefs()[device][name], nil
+	}
+	sha1s, err := n.competingValues(name)
+	if err != nil {
+		return "", err
+	}
+	if len(sha1s) == 0 {
+		return "", nil
+	}
+	return n.mergeRefs(name, sha1s)
+}
+
+// competingValues returns the values of a ref across all devices that have not been buried by a deletion.
+func (n *helper) competingValues(name string) ([]string, error) {
+	var sha1s []string
+	for device, refs := range n.RefDB.deviceRefs() {
+		sha1, found := refs[name]
+		if !found {
+			continue
+		}
+		if buried, err := n.isBuried(device, name, sha1); err != nil {
+			return nil, err
+		} else if !buried {
+			sha1s = append(sha1s, sha1)
+		}
+	}
+	return sha1s, nil
+}
+
+// mergeRefs picks the merged value of a ref that was pushed by several devices, or returns an empty string if the ref
+// is disputed.
+func (n *helper) mergeRefs(name string, sha1s []string) (string, error) {
+	agreed := true
+	for _, sha1 := range sha1s[1:] {
+		if sha1 != sha1s[0] {
+			agreed = false
+		}
+	}
+	if agreed {
+		return sha1s[0], nil
+	}
+	if strings.HasPrefix(name, branchPrefix) {
+		return n.mergeCommits(sha1s)
+	}
+	// tags are not expected to move, so any disagreement about one is a dispute
+	if strings.HasPrefix(name, "refs/tags/") {
+		return "", nil
+	}
+	// other refs (such as notes) can be merged by history, as long as they point at commits
+	for _, sha1 := range sha1s {
+		objectType, err := n.gitObjectType(sha1)
+		if err != nil {
+			return "", err
+		}
+		if objectType != "commit" {
+			return "", nil
+		}
+	}
+	return n.mergeCommits(sha1s)
+}
+
 // mergeCommits returns an empty string if the commits are disputed, or the latest commit if no dispute exists
 func (n *helper) mergeCommits(sha1s []string) (string, error) {
 	proposed := sha1s[0]
@@ -381,17 +820,31 @@ func (n *helper) mergeCommits(sha1s []string) (string, error) {
 }
 
 func (n *helper) List() ([]gitremote.ListRef, error) {
+	return n.listRefs(!n.DryRun)
+}
+
+func (n *helper) ListForPush() ([]gitremote.ListRef, error) {
+	return n.listRefs(false)
+}
+
+// listRefs lists every device's refs and the merged refs. If allowResolve is set, and automatic resolution is enabled,
+// disputed branches are merged and pushed before they are listed.
+func (n *helper) listRefs(allowResolve bool) ([]gitremote.ListRef, error) {
 	if err := n.synch(); err != nil {
 		return nil, err
 	}
 	var allRefs []gitremote.ListRef
 	competitors := map[string][]string{}
-	for device, refs := range n.RefDB.DeviceBranches {
+	// merged ref -> devices, in the same order as competitors
+	competitorDevices := map[string][]string{}
+	// merged ref -> full ref name
+	mergeNames := map[string]string{}
+	for device, refs := range n.RefDB.deviceRefs() {
 		if device == mergeDevice {
 			return nil, errors.New("unexpectedly encountered merge device in branches list")
 		}
-		for branch, sha1 := range refs {
-			ref, err := encodePseudoRef(device, branch)
+		for name, sha1 := range refs {
+			ref, err := encodeRemoteRef(device, name)
 			if err != nil {
 				return nil, err
 			}
@@ -399,11 +852,19 @@ func (n *helper) List() ([]gitremote.ListRef, error) {
 				Sha1: sha1,
 				Name: ref,
 			})
-			mergeRef, err := encodePseudoRef(mergeDevice, branch)
+			mergeRef, err := encodeRemoteRef(mergeDevice, name)
 			if err != nil {
 				return nil, err
 			}
+			// a ref deleted by one device stays deleted in latest, unless another device has moved it further along
+			if buried, err := n.isBuried(device, name, sha1); err != nil {
+				return nil, err
+			} else if buried {
+				continue
+			}
 			competitors[mergeRef] = append(competitors[mergeRef], sha1)
+			competitorDevices[mergeRef] = append(competitorDevices[mergeRef], device)
+			mergeNames[mergeRef] = name
 		}
 	}
 	headRef, err := encodePseudoRef(mergeDevice, "main")
@@ -411,13 +872,29 @@ func (n *helper) List() ([]gitremote.ListRef, error) {
 		return nil, err
 	}
 	var hasHead bool
+	var conflicts []Conflict
 	for mergeRef, sha1s := range competitors {
-		mergeSha1, err := n.mergeCommits(sha1s)
+		mergeSha1, err := n.mergeRefs(mergeNames[mergeRef], sha1s)
 		if err != nil {
 			return nil, err
 		}
 		if mergeSha1 == "" {
-			_, _ = fmt.Fprintf(os.Stderr, "nightmarket: removing disputed branch %q from latest\n", mergeRef)
+			// publish each side of the dispute instead, so that it can be resolved
+			conflict, err := n.describeConflict(mergeNames[mergeRef], competitorDevices[mergeRef], sha1s)
+			if err != nil {
+				return nil, err
+			}
+			var devices []string
+			for _, head := range conflict.Devices {
+				allRefs = append(allRefs, gitremote.ListRef{
+					Sha1: head.Sha1,
+					Name: head.RemoteRef,
+				})
+				devices = append(devices, head.Device)
+			}
+			n.logf(levelWarning, "ref %q is disputed between devices %s; each side is published under %q", mergeRef,
+				strings.Join(devices, ", "), strings.TrimSuffix(conflict.Devices[0].RemoteRef, devices[0]))
+			conflicts = append(conflicts, conflict)
 			continue
 		}
 		allRefs = append(allRefs, gitremote.ListRef{
@@ -428,6 +905,20 @@ func (n *helper) List() ([]gitremote.ListRef, error) {
 			hasHead = true
 		}
 	}
+	if allowResolve && len(conflicts) > 0 {
+		if enabled, err := n.autoResolveEnabled(); err != nil {
+			return nil, err
+		} else if enabled {
+			if resolved, err := n.autoResolve(conflicts); err != nil {
+				return nil, err
+			} else if resolved {
+				return n.listRefs(false)
+			}
+		}
+	}
+	if err := n.writeConflictReport(conflicts); err != nil {
+		return nil, err
+	}
 	sort.Slice(allRefs, func(i, j int) bool {
 		return allRefs[i].Name < allRefs[j].Name
 	})
@@ -440,32 +931,34 @@ func (n *helper) List() ([]gitremote.ListRef, error) {
 	return allRefs, nil
 }
 
-func (n *helper) ListForPush() ([]gitremote.ListRef, error) {
-	return n.List()
-}
-
 func (n *helper) Fetch(refs []gitremote.FetchRef) error {
 	rf := n.RefDB
 	if rf == nil {
 		return errors.New("list required before fetch")
 	}
 	// all fetches have actually already been performed during list, so just make sure it's all okay
+	allRefs := rf.deviceRefs()
 	for _, ref := range refs {
-		device, branch, err := decodePseudoRef(ref.Name)
+		device, name, err := decodeRemoteRef(ref.Name)
 		if err != nil {
 			return err
 		}
 		var acceptable bool
-		if device == mergeDevice {
-			for _, branches := range rf.DeviceBranches {
+		if original, conflictDevice, ok := decodeConflictRefName(name); ok && device == mergeDevice {
+			if sha1, found := allRefs[conflictDevice][original]; found && sha1 == ref.Sha1 {
+				acceptable = true
+			}
+			name = original
+		} else if device == mergeDevice {
+			for _, deviceRefs := range allRefs {
 				// note: this is approximate, because it allows fetches to have slightly the wrong sha1... but this is
 				// really only for consistency checking, so that's fine.
-				if sha1, found := branches[branch]; found && sha1 == ref.Sha1 {
+				if sha1, found := deviceRefs[name]; found && sha1 == ref.Sha1 {
 					acceptable = true
 				}
 			}
 		} else {
-			if sha1, found := rf.DeviceBranches[device][branch]; found && sha1 == ref.Sha1 {
+			if sha1, found := allRefs[device][name]; found && sha1 == ref.Sha1 {
 				acceptable = true
 			}
 		}
@@ -476,7 +969,8 @@ func (n *helper) Fetch(refs []gitremote.FetchRef) error {
 		if err != nil {
 			return err
 		}
-		if objectType != "commit" {
+		// branches must point at commits, but tags and other refs may point at any type of object
+		if strings.HasPrefix(name, branchPrefix) && objectType != "commit" {
 			return fmt.Errorf("did not find expected unpacked object: %q instead of commit", objectType)
 		}
 	}
@@ -488,7 +982,7 @@ func (n *helper) nextPackName(deviceName string) (string, error) {
 	var nextGlobalIndex uint64
 	observed := map[uint64]void{}
 	for _, name := range n.RefDB.MergedPacks {
-		device, infix, _, err := cryptapi.SplitPath(name)
+		device, infix, err := n.objectName(name)
 		if err != nil {
 			return "", err
 		}
@@ -535,14 +1029,41 @@ func (n *helper) Push(refs []gitremote.PushRef) ([]error, error) {
 	if err != nil {
 		return nil, err
 	}
-	header, packPlan, err := n.preparePush(deviceName, refs)
+	header, packPlan, statuses, err := n.preparePush(deviceName, refs)
 	if err != nil {
 		return nil, err
 	}
+	if header == nil {
+		// every ref was rejected, so there is nothing to upload
+		return statuses, nil
+	}
 	infix, err := n.nextPackName(deviceName)
 	if err != nil {
 		return nil, err
 	}
+	if err := n.Clerk.CheckUpload(infix); err != nil {
+		return nil, err
+	}
+	_, deviceIndex, _, err := decodeInfix(infix)
+	if err != nil {
+		return nil, err
+	}
+	// link this pack to our previous pack
+	head, found, err := n.chainHead(deviceName)
+	if err != nil {
+		return nil, err
+	}
+	if found != (deviceIndex > 0) || (found && head.Index+1 != deviceIndex) {
+		return nil, fmt.Errorf("internal error: pack %d does not follow the chain head of device %q", deviceIndex,
+			deviceName)
+	}
+	header.Previous = head.Hash
+	header.Optional = append(header.Optional, chainFeature)
+	if n.DryRun {
+		return n.planPush(infix, header, packPlan, statuses)
+	}
+	hasher := sha256.New()
+	cw := &countWriter{}
 	pr, pw := io.Pipe()
 	encodeDone := make(chan void)
 	go func() {
@@ -551,15 +1072,13 @@ func (n *helper) Push(refs []gitremote.PushRef) ([]error, error) {
 		defer func() {
 			_ = pw.CloseWithError(encodeErr)
 		}()
-		encodeErr = json.NewEncoder(pw).Encode(header)
+		out := io.MultiWriter(pw, hasher)
+		encodeErr = json.NewEncoder(out).Encode(header)
 		if encodeErr != nil {
 			return
 		}
-		cw := &countWriter{}
-		cmd := exec.Command("git", "pack-objects", "--stdout", "--thin", "--revs")
-		cmd.Stdout = io.MultiWriter(pw, cw)
-		cmd.Stdin = strings.NewReader(packPlan)
-		cmd.Stderr = os.Stderr
+		cmd := n.packObjects(packPlan)
+		cmd.Stdout = io.MultiWriter(out, cw)
 		encodeErr = cmd.Run()
 		if encodeErr != nil {
 			return
@@ -569,85 +1088,249 @@ func (n *helper) Push(refs []gitremote.PushRef) ([]error, error) {
 		_ = pr.Close()
 		<-encodeDone
 	}()
-	createdFilename, err := n.Clerk.PutEncryptObjectStream(infix, pr)
+	createdFilename, err := n.Clerk.PutEncryptObjectStreamWithInfo(infix, pr, cryptapi.ObjectInfo{
+		Kind:   cryptapi.KindGitPack,
+		Length: -1,
+	})
 	if err != nil {
 		return nil, err
 	}
 	if len(createdFilename) == 0 {
 		return nil, errors.New("invalid empty created filename")
 	}
+	n.rememberName(createdFilename, infix)
+	// the upload consumed the entire stream, so the encoder has finished writing into the hasher
+	<-encodeDone
+	n.logf(levelVerbose, "uploaded %q (%s)", createdFilename, formatBytes(cw.Length))
+	n.setChainHead(deviceName, chainHead{
+		Index:  deviceIndex,
+		Hash:   hex.EncodeToString(hasher.Sum(nil)),
+		Linked: true,
+	})
 	// mark this as merged so we don't immediately go redownload our own upload
 	if err = n.updateFromHeader(deviceName, createdFilename, header); err != nil {
 		return nil, err
 	}
-	// upload complete; return no errors!
-	return make([]error, len(refs)), nil
+	// upload complete; return the statuses of any rejected refs
+	return statuses, nil
+}
+
+func (n *helper) packObjects(packPlan string) *exec.Cmd {
+	args := []string{"pack-objects", "--stdout", "--thin", "--revs"}
+	if n.Progress {
+		args = append(args, "--progress")
+	} else {
+		args = append(args, "-q")
+	}
+	cmd := exec.Command("git", args...)
+	cmd.Stdin = strings.NewReader(packPlan)
+	cmd.Stderr = os.Stderr
+	return cmd
+}
+
+// planPush validates a push without uploading anything, for --dry-run.
+func (n *helper) planPush(infix string, header *packHeader, packPlan string, statuses []error) ([]error, error) {
+	cw := &countWriter{}
+	cmd := n.packObjects(packPlan)
+	cmd.Stdout = cw
+	if err := cmd.Run(); err != nil {
+		return nil, err
+	}
+	n.logf(levelInfo, "dry run: would upload %q (%s)", infix, formatBytes(cw.Length))
+	for branch, sha1 := range header.Branches {
+		n.logf(levelVerbose, "dry run: would update branch %q to %s", branch, sha1)
+	}
+	for name, sha1 := range header.Refs {
+		n.logf(levelVerbose, "dry run: would update ref %q to %s", name, sha1)
+	}
+	for name := range header.Deleted {
+		n.logf(levelVerbose, "dry run: would delete ref %q", name)
+	}
+	return statuses, nil
+}
+
+// reasons for rejecting a ref during a push. Except for errAtomicFailed, these are the exact messages that git's
+// transport helper code matches to give its usual advice; any other message is only shown as the rejection reason.
+var (
+	errNonFastForward = errors.New("non-fast forward")
+	errAlreadyExists  = errors.New("already exists")
+	errNeedsForce     = errors.New("needs force")
+	errStaleInfo      = errors.New("stale info")
+	errAtomicFailed   = errors.New("atomic push failed")
+)
+
+// checkUpdate decides whether a ref may be moved from previous to next, and returns the reason if not.
+func (n *helper) checkUpdate(name, previous, next string, force bool) (rejection error, err error) {
+	if previous == "" || previous == next {
+		return nil, nil
+	}
+	if strings.HasPrefix(name, "refs/tags/") && !force {
+		return errAlreadyExists, nil
+	}
+	previousType, err := n.gitObjectType(previous)
+	if err != nil {
+		return nil, err
+	}
+	nextType, err := n.gitObjectType(next)
+	if err != nil {
+		return nil, err
+	}
+	isAncestor := false
+	if previousType == "commit" && nextType == "commit" {
+		if isAncestor, err = n.gitIsAncestor(previous, next); err != nil {
+			return nil, err
+		}
+	}
+	if isAncestor {
+		return nil, nil
+	}
+	if !force {
+		if previousType == "commit" && nextType == "commit" {
+			return errNonFastForward, nil
+		}
+		return errNeedsForce, nil
+	}
+	// don't reject the push, because they DID specify a force-push
+	n.logf(levelWarning, "rewinding history during force-push to %q", name)
+	return nil, nil
 }
 
-func (n *helper) preparePush(deviceName string, refs []gitremote.PushRef) (*packHeader, string, error) {
+// preparePush evaluates each ref separately, and returns a status for each. The header is nil if no refs were
+// accepted, in which case there is nothing to upload.
+func (n *helper) preparePush(deviceName string, refs []gitremote.PushRef) (*packHeader, string, []error, error) {
 	rf := n.RefDB
 	if rf == nil {
-		return nil, "", errors.New("list required before push")
+		return nil, "", nil, errors.New("list required before push")
 	}
+	allRefs := rf.deviceRefs()
+	statuses := make([]error, len(refs))
 	branches := map[string]string{}
+	otherRefs := map[string]string{}
+	deleted := map[string]string{}
 	var packPlan strings.Builder
-	for _, ref := range refs {
+	var accepted, rejected bool
+	for i, ref := range refs {
 		// validate and extract branch info
-		device, branch, err := decodePseudoRef(ref.Dest)
+		device, name, err := decodeRemoteRef(ref.Dest)
 		if err != nil {
-			return nil, "", err
+			return nil, "", nil, err
 		}
-		if device == mergeDevice {
-			// if we push to the merged namespace, rewrite so we're actually pushing to our own namespace
-			device = deviceName
-			// TODO: it may be worth detecting the case where we passively do a force-push in this case, because
-			// otherwise we may not detect a force-push when there is a conflict and the latest/ branch was disputed
-			// and not surfaced to Git
-		} else if device != deviceName {
-			return nil, "", fmt.Errorf("attempt to push to branch %q (%q %q) from device %q",
-				ref.Dest, device, branch, deviceName)
+		if device != mergeDevice && device != deviceName {
+			statuses[i] = fmt.Errorf("cannot update ref %q from device %q", ref.Dest, deviceName)
+			rejected = true
+			continue
+		}
+		if _, _, ok := decodeConflictRefName(name); ok {
+			statuses[i] = fmt.Errorf("cannot update ref %q, because refs under %q are reserved", ref.Dest,
+				conflictsPrefix)
+			rejected = true
+			continue
+		}
+		// for --force-with-lease, the ref must still have the value that git expects
+		listed, err := n.listedValue(device, name)
+		if err != nil {
+			return nil, "", nil, err
+		}
+		force := ref.Force
+		if expected, found := n.Leases[ref.Dest]; found {
+			if expected != listed {
+				statuses[i] = errStaleInfo
+				rejected = true
+				continue
+			}
+			// git does not mark these pushes as forced, because a satisfied lease permits the update
+			force = true
+		}
+		if ref.Source == "" {
+			// record a tombstone for whatever value git saw for this ref
+			sha1 := listed
+			if sha1 == "" {
+				statuses[i] = fmt.Errorf("cannot delete %q, because it does not exist", ref.Dest)
+				rejected = true
+				continue
+			}
+			deleted[name] = sha1
+			accepted = true
+			continue
 		}
 		commitHash, err := n.gitRevParse(ref.Source)
 		if err != nil {
-			return nil, "", err
+			return nil, "", nil, err
 		}
-		previousHash, found := branches[branch]
-		if found {
-			isAncestor, err := n.gitIsAncestor(previousHash, commitHash)
+		// check against the value in our own namespace, which is what will actually be replaced
+		rejection, err := n.checkUpdate(name, allRefs[deviceName][name], commitHash, force)
+		if err != nil {
+			return nil, "", nil, err
+		}
+		if rejection == nil && device == mergeDevice {
+			// pushing to the merged namespace actually pushes to our own namespace, so make sure that we don't
+			// create a dispute with any other device's value. this matters even when the merged ref is already
+			// disputed and therefore hidden from git, because git cannot detect that case as a force-push.
+			competitors, err := n.competingValues(name)
 			if err != nil {
-				return nil, "", err
+				return nil, "", nil, err
 			}
-			if !isAncestor {
-				if ref.Force {
-					_, _ = fmt.Fprintf(os.Stderr, "nightmarket: rewinding history during force-push to %q\n", branch)
-					// but don't error out, because they DID specify a force-push
-				} else {
-					return nil, "", fmt.Errorf(
-						"non-force push %q from %q to %q would have rewound history", branch, previousHash, commitHash)
+			for _, competitor := range competitors {
+				if rejection, err = n.checkUpdate(name, competitor, commitHash, force); err != nil {
+					return nil, "", nil, err
+				} else if rejection != nil {
+					break
 				}
 			}
 		}
+		if rejection != nil {
+			statuses[i] = rejection
+			rejected = true
+			continue
+		}
 		// add to branch list
-		branches[branch] = commitHash
+		if strings.HasPrefix(name, branchPrefix) {
+			branches[name[len(branchPrefix):]] = commitHash
+		} else {
+			otherRefs[name] = commitHash
+		}
+		accepted = true
 		// and add to pack plan
 		if _, err = fmt.Fprintln(&packPlan, commitHash); err != nil {
-			return nil, "", err
+			return nil, "", nil, err
+		}
+	}
+	if rejected && n.Atomic {
+		for i := range statuses {
+			if statuses[i] == nil {
+				statuses[i] = errAtomicFailed
+			}
 		}
+		return nil, "", statuses, nil
+	}
+	if !accepted {
+		return nil, "", statuses, nil
 	}
 	// add all known sha1s as exclusions to the pack plan, so we don't upload data already uploaded previously
 	knownLookup := map[string]void{}
-	for _, branchesOnDevice := range rf.DeviceBranches {
-		for _, sha1 := range branchesOnDevice {
+	for _, refsOnDevice := range allRefs {
+		for _, sha1 := range refsOnDevice {
 			if _, found := knownLookup[sha1]; !found {
 				knownLookup[sha1] = void{}
 				if _, err := fmt.Fprintf(&packPlan, "^%s\n", sha1); err != nil {
-					return nil, "", err
+					return nil, "", nil, err
 				}
 			}
 		}
 	}
-	return &packHeader{
-		Version:  version,
+	header := &packHeader{
+		Version:  versionPlain,
 		Branches: branches,
-	}, packPlan.String(), nil
+		Refs:     otherRefs,
+		Deleted:  deleted,
+		// older clients ignore this field, so it can be included at every version
+		Compatibility: util.Compatibility{Client: util.ClientVersion},
+	}
+	if len(otherRefs) > 0 {
+		header.require(refsFeature)
+	}
+	if len(deleted) > 0 {
+		header.require(deletedFeature)
+	}
+	return header, packPlan.String(), statuses, nil
 }
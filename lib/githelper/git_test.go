@@ -0,0 +1,235 @@
+package githelper
+
+import (
+	"encoding/json"
+	"os/exec"
+	"strings"
+	"testing"
+
+	"github.com/celskeggs/nightmarket/lib/util"
+)
+
+func TestRemoteRefRoundTrip(t *testing.T) {
+	for _, test := range []struct {
+		device, name, ref string
+	}{
+		{"A", "refs/heads/main", "refs/heads/A/main"},
+		{"A", "refs/heads/feature/x", "refs/heads/A/feature/x"},
+		{"latest", "refs/heads/main", "refs/heads/latest/main"},
+		{"A", "refs/heads/synced/main", "refs/heads/synced/A/main"},
+		{"latest", "refs/heads/synced/git-annex", "refs/heads/synced/git-annex"},
+		{"A", "refs/tags/v1.0", "refs/tags/A/v1.0"},
+		{"A", "refs/notes/commits", "refs/notes/A/commits"},
+		{"latest", "refs/tags/release/2", "refs/tags/latest/release/2"},
+	} {
+		ref, err := encodeRemoteRef(test.device, test.name)
+		if err != nil {
+			t.Errorf("encodeRemoteRef(%q, %q): %v", test.device, test.name, err)
+		} else if ref != test.ref {
+			t.Errorf("encodeRemoteRef(%q, %q) = %q, expected %q", test.device, test.name, ref, test.ref)
+		}
+		device, name, err := decodeRemoteRef(test.ref)
+		if err != nil {
+			t.Errorf("decodeRemoteRef(%q): %v", test.ref, err)
+		} else if device != test.device || name != test.name {
+			t.Errorf("decodeRemoteRef(%q) = %q, %q, expected %q, %q", test.ref, device, name, test.device, test.name)
+		}
+	}
+}
+
+func TestRemoteRefInvalid(t *testing.T) {
+	for _, ref := range []string{"", "HEAD", "refs/heads/main", "refs/tags/v1.0", "refs/tags//v1.0", "refs/A/x/y z"} {
+		if device, name, err := decodeRemoteRef(ref); err == nil {
+			t.Errorf("decodeRemoteRef(%q) = %q, %q, expected an error", ref, device, name)
+		}
+	}
+	for _, test := range [][2]string{
+		{"A/B", "refs/heads/main"},
+		{"A/B", "refs/tags/v1.0"},
+		{"", "refs/tags/v1.0"},
+		{"A", "refs/tags"},
+		{"A", "HEAD"},
+	} {
+		if ref, err := encodeRemoteRef(test[0], test[1]); err == nil {
+			t.Errorf("encodeRemoteRef(%q, %q) = %q, expected an error", test[0], test[1], ref)
+		}
+	}
+}
+
+// testHelper returns a helper for an empty repository, which git commands run by the helper will use.
+func testHelper(t *testing.T) *helper {
+	gitDir := t.TempDir()
+	if output, err := exec.Command("git", "init", "--quiet", "--bare", gitDir).CombinedOutput(); err != nil {
+		t.Fatalf("git init: %v: %s", err, output)
+	}
+	t.Setenv("GIT_DIR", gitDir)
+	for _, variable := range []string{"GIT_AUTHOR_NAME", "GIT_COMMITTER_NAME"} {
+		t.Setenv(variable, "Test")
+	}
+	for _, variable := range []string{"GIT_AUTHOR_EMAIL", "GIT_COMMITTER_EMAIL"} {
+		t.Setenv(variable, "test@example.com")
+	}
+	return &helper{
+		GitDir: gitDir,
+		RefDB:  &refDBState{},
+		// warnings are not interesting here
+		Verbosity: levelWarning - 1,
+	}
+}
+
+func testGit(t *testing.T, stdin string, args ...string) string {
+	cmd := exec.Command("git", args...)
+	cmd.Stdin = strings.NewReader(stdin)
+	output, err := cmd.Output()
+	if err != nil {
+		t.Fatalf("git %v: %v", args, err)
+	}
+	return strings.TrimSpace(string(output))
+}
+
+// testCommit creates a commit with an empty tree on top of the parents.
+func testCommit(t *testing.T, message string, parents ...string) string {
+	tree := testGit(t, "", "mktree")
+	args := []string{"commit-tree", tree, "-m", message}
+	for _, parent := range parents {
+		args = append(args, "-p", parent)
+	}
+	return testGit(t, "", args...)
+}
+
+func testBlob(t *testing.T, contents string) string {
+	return testGit(t, contents, "hash-object", "-w", "--stdin")
+}
+
+func TestTombstoneBurial(t *testing.T) {
+	n := testHelper(t)
+	base := testCommit(t, "base")
+	deleted := testCommit(t, "deleted", base)
+	later := testCommit(t, "later", deleted)
+	diverged := testCommit(t, "diverged", base)
+	const name = branchPrefix + "main"
+	n.RefDB.Tombstones = map[string]map[string]string{"C": {name: deleted}}
+	n.RefDB.RefOrigins = map[string]map[string]string{"C": {name: "C/push-0-3"}}
+	for _, test := range []struct {
+		sha1   string
+		buried bool
+	}{
+		{deleted, true},
+		{base, true},
+		{later, false},
+		{diverged, false},
+		{testBlob(t, "not a commit"), false},
+	} {
+		buried, err := n.isBuried("A", name, test.sha1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if buried != test.buried {
+			t.Errorf("isBuried(%q) = %v, expected %v", test.sha1, buried, test.buried)
+		}
+	}
+	if buried, err := n.isBuried("A", branchPrefix+"other", deleted); err != nil || buried {
+		t.Errorf("a deletion of another ref buried a value: %v, %v", buried, err)
+	}
+	// setting the ref again after the deletion re-creates it, while setting it concurrently does not
+	n.RefDB.RefOrigins["A"] = map[string]string{name: "A/push-1-4"}
+	n.RefDB.RefOrigins["B"] = map[string]string{name: "B/push-2-3"}
+	if buried, err := n.isBuried("A", name, deleted); err != nil || buried {
+		t.Errorf("a value set after the deletion was buried: %v, %v", buried, err)
+	}
+	if buried, err := n.isBuried("B", name, deleted); err != nil || !buried {
+		t.Errorf("a value set concurrently with the deletion was not buried: %v, %v", buried, err)
+	}
+}
+
+func TestClearTombstone(t *testing.T) {
+	const name = branchPrefix + "main"
+	rf := &refDBState{Tombstones: map[string]map[string]string{
+		"A": {name: "1111111111111111111111111111111111111111"},
+		"B": {name: "2222222222222222222222222222222222222222"},
+	}}
+	rf.clearTombstone("A", name)
+	if _, found := rf.Tombstones["A"][name]; found {
+		t.Error("the pushing device's tombstone was kept")
+	}
+	if _, found := rf.Tombstones["B"][name]; !found {
+		t.Error("another device's tombstone was cleared")
+	}
+	// devices without any tombstones are ignored
+	rf.clearTombstone("C", name)
+}
+
+func TestCheckUpdate(t *testing.T) {
+	n := testHelper(t)
+	base := testCommit(t, "base")
+	ahead := testCommit(t, "ahead", base)
+	diverged := testCommit(t, "diverged", base)
+	blob := testBlob(t, "not a commit")
+	for _, test := range []struct {
+		name, previous, next string
+		force                bool
+		expected             error
+	}{
+		{"refs/heads/main", "", ahead, false, nil},
+		{"refs/heads/main", ahead, ahead, false, nil},
+		{"refs/heads/main", base, ahead, false, nil},
+		{"refs/heads/main", ahead, diverged, false, errNonFastForward},
+		{"refs/heads/main", ahead, base, false, errNonFastForward},
+		{"refs/heads/main", ahead, diverged, true, nil},
+		{"refs/heads/main", ahead, blob, false, errNeedsForce},
+		{"refs/heads/main", ahead, blob, true, nil},
+		{"refs/tags/v1.0", "", base, false, nil},
+		{"refs/tags/v1.0", base, base, false, nil},
+		{"refs/tags/v1.0", base, ahead, false, errAlreadyExists},
+		{"refs/tags/v1.0", base, ahead, true, nil},
+	} {
+		rejection, err := n.checkUpdate(test.name, test.previous, test.next, test.force)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rejection != test.expected {
+			t.Errorf("checkUpdate(%q, %q, %q, %v) = %v, expected %v", test.name, test.previous, test.next,
+				test.force, rejection, test.expected)
+		}
+	}
+}
+
+func TestParsePackHeaderFeatures(t *testing.T) {
+	header, err := parsePackHeader("A/push-0-0#hash",
+		[]byte(`{"version":1,"branches":{"main":"sha1"},"extensions":["unknown-extension"]}`+"\n"))
+	if err != nil {
+		t.Errorf("pack with an unknown optional feature was rejected: %v", err)
+	} else if header.Branches["main"] != "sha1" {
+		t.Errorf("pack header was not decoded: %v", header)
+	}
+	_, err = parsePackHeader("A/push-0-0#hash",
+		[]byte(`{"version":1,"branches":{},"requires":["unknown-feature"]}`+"\n"))
+	if err == nil || !strings.Contains(err.Error(), "unknown-feature") {
+		t.Errorf("pack with an unknown required feature was not rejected: %v", err)
+	}
+	_, err = parsePackHeader("A/push-0-0#hash", []byte(`{"version":1000,"branches":{}}`+"\n"))
+	if err == nil {
+		t.Error("pack with a newer version was not rejected")
+	}
+}
+
+func TestRequiredPackFeatures(t *testing.T) {
+	for feature, header := range map[string]*packHeader{
+		refsFeature:    {Version: versionPlain, Refs: map[string]string{"refs/tags/v1.0": "sha1"}},
+		deletedFeature: {Version: versionPlain, Deleted: map[string]string{"refs/heads/old": "sha1"}},
+	} {
+		header.require(feature)
+		headerBytes, err := json.Marshal(header)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := parsePackHeader("A/push-0-0#hash", headerBytes); err != nil {
+			t.Errorf("pack requiring %q was rejected: %v", feature, err)
+		}
+		// a client from before the feature must refuse the pack rather than silently dropping what it carries
+		older := util.FormatReader{Name: "pack", Oldest: versionPlain, Newest: versionPlain}
+		if err := older.Check(header.Version, header.Compatibility); err == nil {
+			t.Errorf("pack requiring %q was readable by a client that does not understand it", feature)
+		}
+	}
+}
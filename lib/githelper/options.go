@@ -0,0 +1,119 @@
+package githelper
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/celskeggs/nightmarket/lib/gitremote"
+)
+
+// verbosity levels, as sent by git: 0 for --quiet, 1 by default, and higher for each --verbose
+const (
+	levelWarning = 0
+	levelInfo    = 1
+	levelVerbose = 2
+)
+
+const progressInterval = 250 * time.Millisecond
+
+func parseBool(value string) (bool, error) {
+	switch value {
+	case "true":
+		return true, nil
+	case "false":
+		return false, nil
+	default:
+		return false, fmt.Errorf("invalid boolean %q", value)
+	}
+}
+
+func (n *helper) SetOption(name, value string) error {
+	var err error
+	switch name {
+	case "verbosity":
+		n.Verbosity, err = strconv.Atoi(value)
+	case "progress":
+		n.Progress, err = parseBool(value)
+	case "dry-run":
+		n.DryRun, err = parseBool(value)
+	case "atomic":
+		n.Atomic, err = parseBool(value)
+	case "cas":
+		err = n.addLease(value)
+	default:
+		return gitremote.ErrUnsupportedOption
+	}
+	return err
+}
+
+// addLease records the value that git expects a ref to have before it is pushed, for --force-with-lease. The value is
+// in the form <ref>:<sha1>, where a zero sha1 means that the ref is expected not to exist.
+func (n *helper) addLease(value string) error {
+	if strings.HasPrefix(value, "\"") {
+		unquoted, err := strconv.Unquote(value)
+		if err != nil {
+			return err
+		}
+		value = unquoted
+	}
+	parts := strings.SplitN(value, ":", 2)
+	if len(parts) != 2 || gitremote.PartiallyValidateRefName(parts[0]) != nil || len(parts[1]) != 40 {
+		return fmt.Errorf("invalid cas value %q", value)
+	}
+	expected := parts[1]
+	if strings.Trim(expected, "0") == "" {
+		expected = ""
+	}
+	if n.Leases == nil {
+		n.Leases = map[string]string{}
+	}
+	n.Leases[parts[0]] = expected
+	return nil
+}
+
+// logf reports a message on stderr if the verbosity is at least level.
+func (n *helper) logf(level int, format string, args ...interface{}) {
+	if n.Verbosity >= level {
+		_, _ = fmt.Fprintf(os.Stderr, "nightmarket: "+format+"\n", args...)
+	}
+}
+
+func formatBytes(count int64) string {
+	switch {
+	case count >= 1024*1024*1024:
+		return fmt.Sprintf("%.2f GiB", float64(count)/(1024*1024*1024))
+	case count >= 1024*1024:
+		return fmt.Sprintf("%.2f MiB", float64(count)/(1024*1024))
+	case count >= 1024:
+		return fmt.Sprintf("%.2f KiB", float64(count)/1024)
+	default:
+		return fmt.Sprintf("%d bytes", count)
+	}
+}
+
+// progressReader reports how much data has passed through it on stderr, at most once per progressInterval.
+type progressReader struct {
+	r     io.Reader
+	label string
+	count int64
+	last  time.Time
+}
+
+func (p *progressReader) Read(b []byte) (int, error) {
+	n, err := p.r.Read(b)
+	p.count += int64(n)
+	if now := time.Now(); now.Sub(p.last) >= progressInterval {
+		p.last = now
+		_, _ = fmt.Fprintf(os.Stderr, "\rnightmarket: %s: %s", p.label, formatBytes(p.count))
+	}
+	return n, err
+}
+
+// Done finishes the progress line.
+func (p *progressReader) Done() {
+	_, _ = fmt.Fprintf(os.Stderr, "\rnightmarket: %s: %s, done.\n", p.label, formatBytes(p.count))
+}
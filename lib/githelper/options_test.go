@@ -0,0 +1,47 @@
+package githelper
+
+import "testing"
+
+func TestAddLease(t *testing.T) {
+	n := &helper{}
+	for _, value := range []string{
+		"refs/heads/A/main:1111111111111111111111111111111111111111",
+		`"refs/heads/A/quoted:2222222222222222222222222222222222222222"`,
+		"refs/heads/A/absent:0000000000000000000000000000000000000000",
+	} {
+		if err := n.SetOption("cas", value); err != nil {
+			t.Errorf("SetOption(cas, %q): %v", value, err)
+		}
+	}
+	for ref, expected := range map[string]string{
+		"refs/heads/A/main":   "1111111111111111111111111111111111111111",
+		"refs/heads/A/quoted": "2222222222222222222222222222222222222222",
+		// a zero sha1 means that the ref must not exist
+		"refs/heads/A/absent": "",
+	} {
+		if lease, found := n.Leases[ref]; !found || lease != expected {
+			t.Errorf("lease for %q is %q (found=%v), expected %q", ref, lease, found, expected)
+		}
+	}
+	if len(n.Leases) != 3 {
+		t.Errorf("expected 3 leases, found %d", len(n.Leases))
+	}
+}
+
+func TestAddLeaseInvalid(t *testing.T) {
+	n := &helper{}
+	for _, value := range []string{
+		"refs/heads/A/main",
+		"refs/heads/A/main:1234",
+		":1111111111111111111111111111111111111111",
+		`"refs/heads/A/main:1111111111111111111111111111111111111111`,
+		"refs/heads/A/ma in:1111111111111111111111111111111111111111",
+	} {
+		if err := n.addLease(value); err == nil {
+			t.Errorf("addLease(%q) did not fail", value)
+		}
+	}
+	if len(n.Leases) != 0 {
+		t.Errorf("invalid values recorded leases: %v", n.Leases)
+	}
+}
@@ -0,0 +1,221 @@
+package githelper
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+
+	"github.com/celskeggs/nightmarket/lib/gitremote"
+	"github.com/hashicorp/go-multierror"
+)
+
+// AutoResolveKey is the git configuration option that enables the automatic resolution of disputed branches during
+// fetches.
+const AutoResolveKey = "nightmarket.autoResolve"
+
+// Resolvable returns an error if a disputed ref cannot be resolved by merging its competing values.
+func (c Conflict) Resolvable() error {
+	if !strings.HasPrefix(c.Ref, branchPrefix) {
+		return errors.New("only branches can be merged")
+	}
+	if c.Ref == branchPrefix+specialAnnexPath {
+		return errors.New("the git-annex branch is merged by git-annex itself")
+	}
+	return nil
+}
+
+// Heads returns the distinct competing values of a disputed ref.
+func (c Conflict) Heads() []string {
+	var heads []string
+	seen := map[string]void{}
+	for _, head := range c.Devices {
+		if _, found := seen[head.Sha1]; !found {
+			seen[head.Sha1] = void{}
+			heads = append(heads, head.Sha1)
+		}
+	}
+	return heads
+}
+
+// MergedRemoteRef returns the ref under latest/ that a resolution of the dispute should be pushed to.
+func (c Conflict) MergedRemoteRef() (string, error) {
+	return encodeRemoteRef(mergeDevice, c.Ref)
+}
+
+func (c Conflict) MergeMessage() string {
+	var devices []string
+	for _, head := range c.Devices {
+		devices = append(devices, head.Device)
+	}
+	return fmt.Sprintf("Merge disputed %s from devices %s", strings.TrimPrefix(c.Ref, branchPrefix),
+		strings.Join(devices, ", "))
+}
+
+// MergeResult describes the outcome of MergeHeads: either the merge commit, or the files that could not be merged.
+type MergeResult struct {
+	Commit    string
+	Conflicts []string
+}
+
+// worktreeEnv returns the environment for git commands run inside a temporary worktree. The variables that git sets
+// for remote helpers are removed, because they would direct those commands back to the main repository.
+func worktreeEnv() []string {
+	var env []string
+	for _, variable := range os.Environ() {
+		switch strings.SplitN(variable, "=", 2)[0] {
+		case "GIT_DIR", "GIT_WORK_TREE", "GIT_INDEX_FILE", "GIT_PREFIX", "GIT_COMMON_DIR":
+			continue
+		}
+		env = append(env, variable)
+	}
+	return env
+}
+
+func worktreeCommand(worktree string, log io.Writer, args ...string) *exec.Cmd {
+	cmd := exec.Command("git", args...)
+	cmd.Dir = worktree
+	cmd.Env = worktreeEnv()
+	cmd.Stdout = log
+	cmd.Stderr = log
+	return cmd
+}
+
+// MergeHeads merges commits in a temporary worktree of the repository at gitDir, so that neither the current worktree
+// nor any refs are touched. Output from git is written to log, which must not be the remote helper's stdout.
+func MergeHeads(gitDir string, heads []string, message string, log io.Writer) (result *MergeResult, err error) {
+	if len(heads) < 2 {
+		return nil, errors.New("at least two commits are required for a merge")
+	}
+	tempDir, err := os.MkdirTemp("", "nightmarket-resolve-")
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err2 := os.RemoveAll(tempDir); err2 != nil {
+			err = multierror.Append(err, err2)
+		}
+	}()
+	worktree := path.Join(tempDir, "worktree")
+	add := exec.Command("git", "--git-dir", gitDir, "worktree", "add", "--quiet", "--detach", worktree, heads[0])
+	add.Stdout = log
+	add.Stderr = log
+	if err := add.Run(); err != nil {
+		return nil, err
+	}
+	defer func() {
+		remove := exec.Command("git", "--git-dir", gitDir, "worktree", "remove", "--force", worktree)
+		remove.Stdout = log
+		remove.Stderr = log
+		if err2 := remove.Run(); err2 != nil {
+			err = multierror.Append(err, err2)
+		}
+	}()
+	// merge one head at a time, because an octopus merge cannot report which files conflict
+	for _, head := range heads[1:] {
+		mergeErr := worktreeCommand(worktree, log, "merge", "--quiet", "--no-ff", "--no-edit", "-m", message,
+			head).Run()
+		if mergeErr == nil {
+			continue
+		}
+		diff := worktreeCommand(worktree, log, "diff", "--name-only", "--diff-filter=U")
+		diff.Stdout = nil
+		output, err := diff.Output()
+		if err != nil {
+			return nil, err
+		}
+		var conflicts []string
+		for _, line := range strings.Split(string(output), "\n") {
+			if line != "" {
+				conflicts = append(conflicts, line)
+			}
+		}
+		if len(conflicts) == 0 {
+			// the merge failed for some reason other than a conflict
+			return nil, mergeErr
+		}
+		return &MergeResult{Conflicts: conflicts}, nil
+	}
+	revParse := worktreeCommand(worktree, log, "rev-parse", "--verify", "HEAD")
+	revParse.Stdout = nil
+	output, err := revParse.Output()
+	if err != nil {
+		return nil, err
+	}
+	return &MergeResult{Commit: strings.TrimSpace(string(output))}, nil
+}
+
+// hasCommitterIdentity returns true if git has an identity to record on merge commits.
+func hasCommitterIdentity() bool {
+	return exec.Command("git", "var", "GIT_COMMITTER_IDENT").Run() == nil
+}
+
+func (n *helper) autoResolveEnabled() (bool, error) {
+	output, err := exec.Command("git", "config", "--type=bool", "--get", AutoResolveKey).Output()
+	if ee, ok := err.(*exec.ExitError); ok && ee.ExitCode() == 1 && len(output) == 0 {
+		// not set
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	return strings.TrimSpace(string(output)) == "true", nil
+}
+
+// autoResolve merges the competing values of each disputed branch, and pushes each merge from this device. Disputes
+// with real conflicts are reported and left alone. Returns true if anything was pushed.
+func (n *helper) autoResolve(conflicts []Conflict) (bool, error) {
+	// the outcome of each merge is summarized below, so git's own output is only needed when debugging
+	var log io.Writer = io.Discard
+	if n.Verbosity >= levelVerbose {
+		log = os.Stderr
+	}
+	var refs []gitremote.PushRef
+	for _, conflict := range conflicts {
+		if conflict.Resolvable() != nil {
+			continue
+		}
+		// checked here, rather than left to git merge, so that the reason is clear
+		if !hasCommitterIdentity() {
+			n.logf(levelWarning, "cannot automatically resolve disputed refs, because no committer identity is "+
+				"configured")
+			break
+		}
+		result, err := MergeHeads(n.GitDir, conflict.Heads(), conflict.MergeMessage(), log)
+		if err != nil {
+			// a failed merge should not prevent the fetch itself
+			n.logf(levelWarning, "could not automatically resolve disputed %q: %v", conflict.Ref, err)
+			continue
+		}
+		if len(result.Conflicts) > 0 {
+			n.logf(levelWarning, "cannot automatically resolve disputed %q, because of conflicts in: %s",
+				conflict.Ref, strings.Join(result.Conflicts, ", "))
+			continue
+		}
+		dest, err := conflict.MergedRemoteRef()
+		if err != nil {
+			return false, err
+		}
+		refs = append(refs, gitremote.PushRef{
+			Source: result.Commit,
+			Dest:   dest,
+		})
+	}
+	if len(refs) == 0 {
+		return false, nil
+	}
+	statuses, err := n.Push(refs)
+	if err != nil {
+		return false, err
+	}
+	for i, status := range statuses {
+		if status != nil {
+			n.logf(levelWarning, "could not push automatic resolution of %q: %v", refs[i].Dest, status)
+		} else {
+			n.logf(levelInfo, "resolved disputed %q automatically with merge %s", refs[i].Dest, refs[i].Source)
+		}
+	}
+	return true, nil
+}
@@ -23,12 +23,16 @@ type FetchRef struct {
 }
 
 type PushRef struct {
-	Force  bool
+	Force bool
+	// an empty source requests that the destination be deleted
 	Source string
 	Dest   string
 }
 
 type Helper interface {
+	// SetOption applies an option sent by git, such as "verbosity" or "dry-run", and returns ErrUnsupportedOption if
+	// the helper does not know the option.
+	SetOption(name, value string) error
 	List() ([]ListRef, error)
 	ListForPush() ([]ListRef, error)
 	Fetch(refs []FetchRef) error
@@ -36,6 +40,8 @@ type Helper interface {
 	//Close() error
 }
 
+var ErrUnsupportedOption = errors.New("unsupported option")
+
 func isValidSha1(hash string) error {
 	if len(hash) != 40 {
 		return errors.New("wrong length for a sha1 hash")
@@ -94,7 +100,7 @@ func parseFetchRef(line string) (FetchRef, error) {
 }
 
 func parsePushRef(line string) (PushRef, error) {
-	if !strings.HasPrefix(line, "push ") || len(line) < 8 {
+	if !strings.HasPrefix(line, "push ") {
 		return PushRef{}, fmt.Errorf("invalid fetch line: %q", line)
 	}
 	line = line[5:]
@@ -103,7 +109,7 @@ func parsePushRef(line string) (PushRef, error) {
 		line = line[1:]
 	}
 	parts := strings.Split(line, ":")
-	if len(parts) != 2 || len(parts[0]) == 0 || len(parts[1]) == 0 {
+	if len(parts) != 2 || len(parts[1]) == 0 {
 		return PushRef{}, fmt.Errorf("invalid fetch line: %q", line)
 	}
 	return PushRef{
@@ -125,7 +131,23 @@ func mainloop(in io.Reader, out io.StringWriter, helper Helper) (eo error) {
 			// end of command stream
 			return nil
 		case line == "capabilities":
-			_, err := out.WriteString("fetch\npush\n\n")
+			_, err := out.WriteString("fetch\npush\noption\n\n")
+			if err != nil {
+				return err
+			}
+		case strings.HasPrefix(line, "option "):
+			parts := strings.SplitN(line, " ", 3)
+			if len(parts) != 3 {
+				return fmt.Errorf("invalid option line: %q", line)
+			}
+			err := helper.SetOption(parts[1], parts[2])
+			if err == ErrUnsupportedOption {
+				_, err = out.WriteString("unsupported\n")
+			} else if err != nil {
+				_, err = out.WriteString(fmt.Sprintf("error %s\n", err.Error()))
+			} else {
+				_, err = out.WriteString("ok\n")
+			}
 			if err != nil {
 				return err
 			}
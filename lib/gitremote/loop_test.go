@@ -0,0 +1,165 @@
+package gitremote
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParsePushRef(t *testing.T) {
+	for line, expected := range map[string]PushRef{
+		"push refs/heads/main:refs/heads/A/main":  {Source: "refs/heads/main", Dest: "refs/heads/A/main"},
+		"push +refs/heads/main:refs/heads/A/main": {Force: true, Source: "refs/heads/main", Dest: "refs/heads/A/main"},
+		// an empty source deletes the destination
+		"push :refs/heads/A/old":  {Source: "", Dest: "refs/heads/A/old"},
+		"push +:refs/tags/A/v1.0": {Force: true, Source: "", Dest: "refs/tags/A/v1.0"},
+	} {
+		ref, err := parsePushRef(line)
+		if err != nil {
+			t.Errorf("parsePushRef(%q): %v", line, err)
+		} else if ref != expected {
+			t.Errorf("parsePushRef(%q) = %+v, expected %+v", line, ref, expected)
+		}
+	}
+}
+
+func TestParsePushRefInvalid(t *testing.T) {
+	for _, line := range []string{
+		"fetch 0000000000000000000000000000000000000000 refs/heads/main",
+		"push refs/heads/main",
+		"push refs/heads/main:",
+		"push :",
+		"push a:b:c",
+	} {
+		if ref, err := parsePushRef(line); err == nil {
+			t.Errorf("parsePushRef(%q) = %+v, expected an error", line, ref)
+		}
+	}
+}
+
+// fakeHelper records what the loop asks of it, and answers with canned results.
+type fakeHelper struct {
+	options  [][2]string
+	pushed   []PushRef
+	list     []ListRef
+	statuses []error
+}
+
+func (f *fakeHelper) SetOption(name, value string) error {
+	f.options = append(f.options, [2]string{name, value})
+	switch name {
+	case "verbosity", "progress", "dry-run":
+		return nil
+	case "broken":
+		return errors.New("cannot apply")
+	default:
+		return ErrUnsupportedOption
+	}
+}
+
+func (f *fakeHelper) List() ([]ListRef, error) {
+	return f.list, nil
+}
+
+func (f *fakeHelper) ListForPush() ([]ListRef, error) {
+	return f.list, nil
+}
+
+func (f *fakeHelper) Fetch(refs []FetchRef) error {
+	return nil
+}
+
+func (f *fakeHelper) Push(refs []PushRef) ([]error, error) {
+	f.pushed = append(f.pushed, refs...)
+	return f.statuses, nil
+}
+
+func runLoop(t *testing.T, helper Helper, input string) string {
+	var out strings.Builder
+	if err := mainloop(strings.NewReader(input), &out, helper); err != nil {
+		t.Fatalf("mainloop: %v", err)
+	}
+	return out.String()
+}
+
+func TestMainloopOptions(t *testing.T) {
+	helper := &fakeHelper{}
+	out := runLoop(t, helper, "capabilities\n"+
+		"option verbosity 2\n"+
+		"option progress true\n"+
+		"option dry-run true\n"+
+		"option followtags true\n"+
+		"option broken value with spaces\n"+
+		"\n")
+	expected := "fetch\npush\noption\n\n" +
+		"ok\n" +
+		"ok\n" +
+		"ok\n" +
+		"unsupported\n" +
+		"error cannot apply\n"
+	if out != expected {
+		t.Errorf("unexpected responses:\n%q\nexpected:\n%q", out, expected)
+	}
+	options := [][2]string{
+		{"verbosity", "2"}, {"progress", "true"}, {"dry-run", "true"}, {"followtags", "true"},
+		{"broken", "value with spaces"},
+	}
+	if !reflect.DeepEqual(helper.options, options) {
+		t.Errorf("helper received options %q, expected %q", helper.options, options)
+	}
+}
+
+func TestMainloopPush(t *testing.T) {
+	helper := &fakeHelper{statuses: []error{nil, errors.New("non-fast-forward"), nil}}
+	out := runLoop(t, helper, "option dry-run true\n"+
+		"push refs/heads/main:refs/heads/A/main\n"+
+		"push refs/heads/old:refs/heads/A/old\n"+
+		"push +:refs/tags/A/v1.0\n"+
+		"\n"+
+		"\n")
+	expected := "ok\n" +
+		"ok refs/heads/A/main\n" +
+		"error refs/heads/A/old \"non-fast-forward\"\n" +
+		"ok refs/tags/A/v1.0\n" +
+		"\n"
+	if out != expected {
+		t.Errorf("unexpected responses:\n%q\nexpected:\n%q", out, expected)
+	}
+	pushed := []PushRef{
+		{Source: "refs/heads/main", Dest: "refs/heads/A/main"},
+		{Source: "refs/heads/old", Dest: "refs/heads/A/old"},
+		{Force: true, Source: "", Dest: "refs/tags/A/v1.0"},
+	}
+	if !reflect.DeepEqual(helper.pushed, pushed) {
+		t.Errorf("helper received pushes %+v, expected %+v", helper.pushed, pushed)
+	}
+}
+
+func TestMainloopList(t *testing.T) {
+	sha1 := strings.Repeat("a", 40)
+	helper := &fakeHelper{list: []ListRef{
+		{Sha1: sha1, Name: "refs/heads/A/main"},
+		{Sha1: "@refs/heads/A/main", Name: "HEAD"},
+	}}
+	out := runLoop(t, helper, "list for-push\n\n")
+	expected := sha1 + " refs/heads/A/main\n@refs/heads/A/main HEAD\n\n"
+	if out != expected {
+		t.Errorf("unexpected list:\n%q\nexpected:\n%q", out, expected)
+	}
+}
+
+func TestMainloopErrors(t *testing.T) {
+	for input, helper := range map[string]*fakeHelper{
+		// a helper must report a status for every ref in the batch
+		"push refs/heads/main:refs/heads/A/main\npush refs/heads/x:refs/heads/A/x\n\n": {statuses: []error{nil}},
+		"option verbosity\n":       {},
+		"frobnicate\n":             {},
+		"push refs/heads/main\n\n": {},
+	} {
+		var out strings.Builder
+		if err := mainloop(strings.NewReader(input), &out, helper); err == nil {
+			t.Errorf("input %q was accepted with responses %q", input, out.String())
+		}
+	}
+}
@@ -0,0 +1,170 @@
+package nmcmd
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/celskeggs/nightmarket/lib/cryptapi"
+	"github.com/celskeggs/nightmarket/lib/util"
+	"github.com/hashicorp/go-multierror"
+)
+
+func writeNewFile(path string, data []byte) (err error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err2 := f.Close(); err2 != nil {
+			err = multierror.Append(err, err2)
+		}
+	}()
+	_, err = f.Write(data)
+	return err
+}
+
+func escrowSplit(thresholdStr string, sharePaths []string) error {
+	threshold, err := strconv.Atoi(thresholdStr)
+	if err != nil {
+		return err
+	}
+	if threshold < 2 || threshold > len(sharePaths) {
+		return fmt.Errorf("threshold must be between 2 and the number of shares (%d)", len(sharePaths))
+	}
+	var labels []string
+	for _, sharePath := range sharePaths {
+		if _, err := os.Stat(sharePath); err == nil {
+			return fmt.Errorf("share file already exists: %q", sharePath)
+		} else if !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		labels = append(labels, filepath.Base(sharePath))
+	}
+	configDir, err := getConfigDir(false)
+	if err != nil {
+		return err
+	}
+	prompt := util.Prompter(os.Stdin, os.Stdout)
+	promptSecret := util.SecretPrompter(prompt, os.Stdin, os.Stdout)
+	configPath, err := selectConfiguration(configDir, prompt)
+	if err != nil {
+		return err
+	}
+	clerk, err := cryptapi.LoadConfig(configPath)
+	if err != nil {
+		return err
+	}
+	shares, err := cryptapi.SplitEscrow(cryptapi.EscrowSecretOf(clerk.Config), threshold, labels)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Each share can be encrypted to a device or trustee's age recipient (age1...) or with a passphrase.\n")
+	for i, share := range shares {
+		protection, err := promptSecret(fmt.Sprintf("Recipient or passphrase for share %q> ", share.Label))
+		if err != nil {
+			return err
+		}
+		if !strings.HasPrefix(protection, "age1") {
+			confirm, err := promptSecret("Confirm passphrase> ")
+			if err != nil {
+				return err
+			}
+			if confirm != protection {
+				return errors.New("passphrases do not match")
+			}
+		}
+		sealed, err := cryptapi.SealShare(share, protection)
+		if err != nil {
+			return err
+		}
+		if err := writeNewFile(sharePaths[i], sealed); err != nil {
+			return err
+		}
+	}
+	fmt.Printf("Wrote %d shares; any %d of them recover the encryption keys of epochs 0 through %d.\n",
+		len(shares), threshold, clerk.Config.Epoch)
+	return nil
+}
+
+func escrowCombine(sharePaths []string) error {
+	prompt := util.Prompter(os.Stdin, os.Stdout)
+	promptSecret := util.SecretPrompter(prompt, os.Stdin, os.Stdout)
+	var shares []cryptapi.EscrowShare
+	for _, sharePath := range sharePaths {
+		data, err := os.ReadFile(sharePath)
+		if err != nil {
+			return err
+		}
+		protection, err := promptSecret(fmt.Sprintf("Identity or passphrase for share %q> ", sharePath))
+		if err != nil {
+			return err
+		}
+		share, err := cryptapi.OpenShare(data, protection)
+		if err != nil {
+			return fmt.Errorf("while opening share %q: %w", sharePath, err)
+		}
+		fmt.Printf("Share %q is valid: share %d of %d, threshold %d.\n",
+			share.Label, share.Index, len(share.Checksums), share.Threshold)
+		shares = append(shares, share)
+	}
+	secret, err := cryptapi.CombineEscrow(shares)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Recovered the encryption key for epoch %d, along with %d older keys.\n",
+		secret.Epoch, len(secret.Keyring))
+	install, err := prompt("Install the recovered keys into a configuration (y/n)? ")
+	if err != nil {
+		return err
+	}
+	if strings.ToLower(install) != "y" {
+		encoded, err := json.MarshalIndent(secret, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Recovered keys (keep secret):\n%s\n", encoded)
+		return nil
+	}
+	configDir, err := getConfigDir(true)
+	if err != nil {
+		return err
+	}
+	configPath, err := selectConfiguration(configDir, prompt)
+	if err != nil {
+		return err
+	}
+	config, err := cryptapi.ReadConfig(configPath)
+	if err != nil {
+		return err
+	}
+	if config.SecretKeySource != nil {
+		return errors.New("configuration takes its secret key from a secret source: install the key there instead")
+	}
+	config = secret.Install(config)
+	// make sure the new configuration is usable before saving it
+	if _, err := cryptapi.NewClerk(config); err != nil {
+		return err
+	}
+	if err := replaceJSON(config, configPath); err != nil {
+		return err
+	}
+	fmt.Printf("Installed the recovered keys into %q.\n", configPath)
+	return nil
+}
+
+func escrowCommand(args []string) error {
+	switch {
+	case len(args) >= 3 && args[0] == "split":
+		return escrowSplit(args[1], args[2:])
+	case len(args) >= 2 && args[0] == "combine":
+		return escrowCombine(args[1:])
+	default:
+		return errors.New("expected: escrow split <threshold> <share-file>... | escrow combine <share-file>...")
+	}
+}
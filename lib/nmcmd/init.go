@@ -121,15 +121,29 @@ func getConfigDir(create bool) (string, error) {
 }
 
 func describeExistingConfig(configPath string) (selectable bool, description string) {
-	clerk, err := cryptapi.LoadConfig(configPath)
+	// avoid asking for passphrases, running secret commands, or loading policies merely to list the configurations
+	encrypted, err := cryptapi.IsEncryptedConfig(configPath)
 	if err != nil {
 		return false, err.Error()
 	}
-	conf := clerk.Config.SpaceConfig
+	if encrypted {
+		return true, "encrypted configuration"
+	}
+	config, err := cryptapi.ReadConfig(configPath)
+	if err != nil {
+		return false, err.Error()
+	}
+	if config.SecretKeySource == nil && config.TokenSource == nil && config.AdminKey == "" {
+		if _, err := cryptapi.NewClerk(config); err != nil {
+			return false, err.Error()
+		}
+	}
+	conf := config.SpaceConfig
 	return true, fmt.Sprintf("store=%q func=%q device=%q", conf.SpacePrefix, conf.URL, conf.DeviceName)
 }
 
 func promptConfig(prompt func(string) (string, error)) (cryptapi.ClerkConfig, error) {
+	promptSecret := util.SecretPrompter(prompt, os.Stdin, os.Stdout)
 	var config cryptapi.ClerkConfig
 	for {
 		url, err := prompt("Function DNS Name> ")
@@ -160,16 +174,17 @@ func promptConfig(prompt func(string) (string, error)) (cryptapi.ClerkConfig, er
 		return cryptapi.ClerkConfig{}, err
 	}
 	config.SpaceConfig.DeviceName = device
-	token, err := prompt("Device Token> ")
+	token, err := promptSecret("Device Token> ")
 	if err != nil {
 		return cryptapi.ClerkConfig{}, err
 	}
 	config.SpaceConfig.DeviceToken = token
-	encryptionKey, err := prompt("Encryption Key> ")
+	encryptionKey, err := promptSecret("Encryption Key> ")
 	if err != nil {
 		return cryptapi.ClerkConfig{}, err
 	}
 	config.SecretKey = encryptionKey
+	config.KeyVersion = cryptapi.LatestKeyVersion
 	clerk, err := cryptapi.NewClerk(config)
 	if err != nil {
 		return cryptapi.ClerkConfig{}, err
@@ -187,6 +202,48 @@ func promptConfig(prompt func(string) (string, error)) (cryptapi.ClerkConfig, er
 		return cryptapi.ClerkConfig{}, errors.New("invalid factor")
 	}
 	config.WorkFactor = int(factorNum)
+	derive, err := prompt("Derive a long-term key once at load, instead of running scrypt for every object (y/n)? ")
+	if err != nil {
+		return cryptapi.ClerkConfig{}, err
+	}
+	config.DeriveKeyOnce = strings.ToLower(derive) == "y"
+	compress, err := prompt("Compress uploads when it reduces their size (y/n)? ")
+	if err != nil {
+		return cryptapi.ClerkConfig{}, err
+	}
+	if strings.ToLower(compress) == "y" {
+		config.Compression = cryptapi.CompressionDeflate
+	}
+	pad, err := prompt("Pad uploads to hide their exact sizes (y/n)? ")
+	if err != nil {
+		return cryptapi.ClerkConfig{}, err
+	}
+	if strings.ToLower(pad) == "y" {
+		config.Padding = cryptapi.PaddingPadme
+	}
+	opaque, err := prompt("Hide object names from the storage provider (y/n)? ")
+	if err != nil {
+		return cryptapi.ClerkConfig{}, err
+	}
+	config.OpaqueNames = strings.ToLower(opaque) == "y"
+	hide, err := prompt("Hide device names from the storage provider (y/n)? ")
+	if err != nil {
+		return cryptapi.ClerkConfig{}, err
+	}
+	if strings.ToLower(hide) == "y" {
+		// every device in the space must use the same alias key, so that the others can tell who stored an object
+		if config.DeviceAliasKey, err = promptSecret("Device Alias Key> "); err != nil {
+			return cryptapi.ClerkConfig{}, err
+		}
+		if config.DeviceAliasKey == "" {
+			return cryptapi.ClerkConfig{}, errors.New("device alias key cannot be empty")
+		}
+		if clerk, err = cryptapi.NewClerk(config); err != nil {
+			return cryptapi.ClerkConfig{}, err
+		}
+		fmt.Printf("This device must be registered with the watchdemon as %q (see token alias).\n",
+			clerk.RemoteClerk.DirectoryName())
+	}
 	if _, err := clerk.ListObjects(); err != nil {
 		return cryptapi.ClerkConfig{}, err
 	}
@@ -210,6 +267,27 @@ func writeJSON(data interface{}, filepath string) (err error) {
 	return json.NewEncoder(f).Encode(data)
 }
 
+// replaceJSON atomically replaces an existing configuration file, keeping it protected from other users.
+func replaceJSON(data interface{}, filepath string) error {
+	encrypted, err := cryptapi.IsEncryptedConfig(filepath)
+	if err != nil {
+		return err
+	}
+	if encrypted {
+		// writing the configuration back out would silently remove its encryption
+		return fmt.Errorf("configuration %q is encrypted: decrypt it, rerun this command, and then encrypt it again",
+			filepath)
+	}
+	tempPath := filepath + ".new"
+	if err := writeJSON(data, tempPath); err != nil {
+		return err
+	}
+	if err := os.Rename(tempPath, filepath); err != nil {
+		return multierror.Append(err, os.Remove(tempPath))
+	}
+	return nil
+}
+
 func promptCreateNewConfig(configDir string, prompt func(string) (string, error)) (string, error) {
 	fmt.Printf("To create a new configuration, enter the following information:\n")
 	var filepath string
@@ -0,0 +1,96 @@
+package nmcmd
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/celskeggs/nightmarket/lib/cryptapi"
+	"github.com/celskeggs/nightmarket/lib/util"
+)
+
+func orUnknown(value string) string {
+	if value == "" {
+		return "(unknown)"
+	}
+	return value
+}
+
+func orNone(value string) string {
+	if value == "" {
+		return "none"
+	}
+	return value
+}
+
+func printHeader(objectPath string, header *cryptapi.StreamHeader) {
+	fmt.Printf("Object:       %s\n", objectPath)
+	fmt.Printf("Device:       %s\n", header.Device)
+	fmt.Printf("Infix:        %s\n", header.Infix)
+	if header.Name != "" {
+		fmt.Printf("Name:         %s\n", header.Name)
+	}
+	fmt.Printf("Kind:         %s\n", orUnknown(header.Kind))
+	if header.AnnexKey != "" {
+		fmt.Printf("Annex key:    %s\n", header.AnnexKey)
+	}
+	if header.CreatedMs != 0 {
+		fmt.Printf("Created:      %s\n", time.UnixMilli(header.CreatedMs).Format(time.RFC3339))
+	} else {
+		fmt.Printf("Created:      (unknown)\n")
+	}
+	if header.Length != nil {
+		fmt.Printf("Length:       %d bytes\n", *header.Length)
+	} else {
+		fmt.Printf("Length:       (unknown)\n")
+	}
+	if header.Client != "" {
+		fmt.Printf("Written by:   nightmarket %s\n", header.Client)
+	} else {
+		fmt.Printf("Written by:   (unknown)\n")
+	}
+	fmt.Printf("Format:       version %d", header.Version)
+	if header.MinVersion != 0 {
+		fmt.Printf(" (readable from version %d)", header.MinVersion)
+	}
+	fmt.Println()
+	if len(header.Required) > 0 {
+		fmt.Printf("Requires:     %s\n", strings.Join(header.Required, ", "))
+	}
+	if len(header.Optional) > 0 {
+		fmt.Printf("Extensions:   %s\n", strings.Join(header.Optional, ", "))
+	}
+	fmt.Printf("Key:          epoch %d, key version %d\n", header.Epoch, header.KeyVersion)
+	fmt.Printf("Compression:  %s\n", orNone(header.Compression))
+	fmt.Printf("Padding:      %s\n", orNone(header.Padding))
+	if header.IsSigned() {
+		fmt.Printf("Signed:       yes (not verified, because only the header was downloaded)\n")
+	} else {
+		fmt.Printf("Signed:       no\n")
+	}
+}
+
+func inspectObject(objectPath string) error {
+	if _, _, _, err := cryptapi.SplitPath(objectPath); err != nil {
+		return err
+	}
+	configDir, err := getConfigDir(false)
+	if err != nil {
+		return err
+	}
+	prompt := util.Prompter(os.Stdin, os.Stdout)
+	configPath, err := selectConfiguration(configDir, prompt)
+	if err != nil {
+		return err
+	}
+	clerk, err := loadClerk(configPath)
+	if err != nil {
+		return err
+	}
+	header, err := clerk.InspectObject(objectPath)
+	if header != nil {
+		printHeader(objectPath, header)
+	}
+	return err
+}
@@ -18,9 +18,70 @@ func Main() {
 			_, _ = fmt.Fprintf(os.Stderr, "%s repair: %v\n", os.Args[0], err)
 			os.Exit(1)
 		}
+	} else if len(os.Args) == 2 && os.Args[1] == "rekey" {
+		err := rekeyRepo()
+		if err != nil {
+			_, _ = fmt.Fprintf(os.Stderr, "%s rekey: %v\n", os.Args[0], err)
+			os.Exit(1)
+		}
+	} else if len(os.Args) == 3 && os.Args[1] == "inspect" {
+		err := inspectObject(os.Args[2])
+		if err != nil {
+			_, _ = fmt.Fprintf(os.Stderr, "%s inspect: %v\n", os.Args[0], err)
+			os.Exit(1)
+		}
+	} else if len(os.Args) >= 3 && os.Args[1] == "token" {
+		err := tokenCommand(os.Args[2:])
+		if err != nil {
+			_, _ = fmt.Fprintf(os.Stderr, "%s token: %v\n", os.Args[0], err)
+			os.Exit(1)
+		}
+	} else if len(os.Args) >= 3 && os.Args[1] == "roster" {
+		err := rosterCommand(os.Args[2:])
+		if err != nil {
+			_, _ = fmt.Fprintf(os.Stderr, "%s roster: %v\n", os.Args[0], err)
+			os.Exit(1)
+		}
+	} else if len(os.Args) >= 3 && os.Args[1] == "escrow" {
+		err := escrowCommand(os.Args[2:])
+		if err != nil {
+			_, _ = fmt.Fprintf(os.Stderr, "%s escrow: %v\n", os.Args[0], err)
+			os.Exit(1)
+		}
+	} else if len(os.Args) >= 3 && os.Args[1] == "policy" {
+		err := policyCommand(os.Args[2:])
+		if err != nil {
+			_, _ = fmt.Fprintf(os.Stderr, "%s policy: %v\n", os.Args[0], err)
+			os.Exit(1)
+		}
+	} else if len(os.Args) >= 2 && os.Args[1] == "status" {
+		err := statusCommand(os.Args[2:])
+		if err != nil {
+			_, _ = fmt.Fprintf(os.Stderr, "%s status: %v\n", os.Args[0], err)
+			os.Exit(1)
+		}
+	} else if len(os.Args) >= 2 && os.Args[1] == "resolve" {
+		err := resolveCommand(os.Args[2:])
+		if err != nil {
+			_, _ = fmt.Fprintf(os.Stderr, "%s resolve: %v\n", os.Args[0], err)
+			os.Exit(1)
+		}
 	} else {
 		_, _ = fmt.Fprintf(os.Stderr, "usage: %s init <annex-directory>\n", os.Args[0])
 		_, _ = fmt.Fprintf(os.Stderr, "usage: %s repair\n", os.Args[0])
+		_, _ = fmt.Fprintf(os.Stderr, "usage: %s rekey\n", os.Args[0])
+		_, _ = fmt.Fprintf(os.Stderr, "usage: %s inspect <object-path>\n", os.Args[0])
+		_, _ = fmt.Fprintf(os.Stderr, "usage: %s token generate <device> [target-ms [runtime-cores]]\n", os.Args[0])
+		_, _ = fmt.Fprintf(os.Stderr, "       (%s)\n", tokenHelp)
+		_, _ = fmt.Fprintf(os.Stderr, "usage: %s token alias <device>\n", os.Args[0])
+		_, _ = fmt.Fprintf(os.Stderr, "usage: %s roster keygen | identity\n", os.Args[0])
+		_, _ = fmt.Fprintf(os.Stderr, "usage: %s roster sign <admin-key-file> <roster-file>\n", os.Args[0])
+		_, _ = fmt.Fprintf(os.Stderr, "usage: %s roster install <signed-roster-file>\n", os.Args[0])
+		_, _ = fmt.Fprintf(os.Stderr, "usage: %s escrow split <threshold> <share-file>...\n", os.Args[0])
+		_, _ = fmt.Fprintf(os.Stderr, "usage: %s escrow combine <share-file>...\n", os.Args[0])
+		_, _ = fmt.Fprintf(os.Stderr, "usage: %s policy publish <admin-key-file> <policy-file> | show\n", os.Args[0])
+		_, _ = fmt.Fprintf(os.Stderr, "usage: %s status [--json]\n", os.Args[0])
+		_, _ = fmt.Fprintf(os.Stderr, "usage: %s resolve [<remote>] | resolve --auto on|off\n", os.Args[0])
 		os.Exit(1)
 	}
 }
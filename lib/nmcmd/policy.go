@@ -0,0 +1,106 @@
+package nmcmd
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/celskeggs/nightmarket/lib/cryptapi"
+	"github.com/celskeggs/nightmarket/lib/util"
+)
+
+// loadClerk loads a configuration and the space's policy, for commands that access the space. Commands do not
+// remember policy serials between runs, so rollbacks are only detected by the remote helpers.
+func loadClerk(configPath string) (*cryptapi.Clerk, error) {
+	clerk, err := cryptapi.LoadConfig(configPath)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := clerk.LoadPolicy(0); err != nil {
+		return nil, err
+	}
+	return clerk, nil
+}
+
+func policyPublish(adminKeyPath, policyPath string) error {
+	adminKey, err := readTrimmedFile(adminKeyPath)
+	if err != nil {
+		return err
+	}
+	policyData, err := os.ReadFile(policyPath)
+	if err != nil {
+		return err
+	}
+	var policy cryptapi.Policy
+	if err := json.Unmarshal(policyData, &policy); err != nil {
+		return err
+	}
+	signed, err := cryptapi.SignPolicy(policy, adminKey)
+	if err != nil {
+		return err
+	}
+	configDir, err := getConfigDir(false)
+	if err != nil {
+		return err
+	}
+	prompt := util.Prompter(os.Stdin, os.Stdout)
+	configPath, err := selectConfiguration(configDir, prompt)
+	if err != nil {
+		return err
+	}
+	clerk, err := loadClerk(configPath)
+	if err != nil {
+		return err
+	}
+	public, err := cryptapi.AdminPublicKey(adminKey)
+	if err != nil {
+		return err
+	}
+	if clerk.Config.AdminKey != public {
+		return errors.New("configuration does not list this admin key, so it would ignore the policy")
+	}
+	objectPath, err := clerk.PublishPolicy(signed)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Published policy serial %d as %q.\n", policy.Serial, objectPath)
+	return nil
+}
+
+func policyShow() error {
+	configDir, err := getConfigDir(false)
+	if err != nil {
+		return err
+	}
+	prompt := util.Prompter(os.Stdin, os.Stdout)
+	configPath, err := selectConfiguration(configDir, prompt)
+	if err != nil {
+		return err
+	}
+	clerk, err := loadClerk(configPath)
+	if err != nil {
+		return err
+	}
+	if clerk.Policy == nil {
+		fmt.Println("No policy signed by the configured admin key has been published.")
+		return nil
+	}
+	encoded, err := json.MarshalIndent(clerk.Policy, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%s\n", encoded)
+	return nil
+}
+
+func policyCommand(args []string) error {
+	switch {
+	case len(args) == 3 && args[0] == "publish":
+		return policyPublish(args[1], args[2])
+	case len(args) == 1 && args[0] == "show":
+		return policyShow()
+	default:
+		return errors.New("expected: policy publish <admin-key-file> <policy-file> | policy show")
+	}
+}
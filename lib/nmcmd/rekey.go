@@ -0,0 +1,173 @@
+package nmcmd
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/celskeggs/nightmarket/lib/cryptapi"
+	"github.com/celskeggs/nightmarket/lib/util"
+	"github.com/hashicorp/go-multierror"
+)
+
+// reencrypt uploads a fresh copy of an object sealed under the current key epoch, and returns the new path.
+func reencrypt(clerk *cryptapi.Clerk, objectPath string) (newPath string, err error) {
+	header, rc, err := clerk.GetDecryptObjectStreamWithHeader(objectPath)
+	if err != nil {
+		return "", err
+	}
+	name := header.Infix
+	if header.Name != "" {
+		name = header.Name
+	}
+	defer func() {
+		if err2 := rc.Close(); err2 != nil {
+			err = multierror.Append(err, err2)
+		}
+	}()
+	info := cryptapi.ObjectInfo{
+		Kind:     header.Kind,
+		AnnexKey: header.AnnexKey,
+		Length:   -1,
+	}
+	if header.Length != nil {
+		info.Length = *header.Length
+	}
+	return clerk.PutEncryptObjectStreamWithInfo(name, rc, info)
+}
+
+// staleObjects lists the objects uploaded by this device that were sealed before the current key epoch or key version,
+// or whose names do not match the current naming mode. Objects that the policy retains are skipped, because their
+// originals could not be deleted.
+func staleObjects(clerk *cryptapi.Clerk) ([]string, error) {
+	// objects stored before this device was given an alias cannot be replaced, since only the alias can authenticate
+	directory := clerk.RemoteClerk.DirectoryName()
+	objects, err := clerk.ListObjects()
+	if err != nil {
+		return nil, err
+	}
+	var stale []string
+	for _, objectPath := range objects {
+		objectDirectory, _, _, err := cryptapi.SplitPath(objectPath)
+		if err != nil {
+			return nil, err
+		}
+		if objectDirectory != directory {
+			continue
+		}
+		// only the header is needed here; reencrypt checks the whole object before anything is replaced
+		header, err := clerk.InspectObject(objectPath)
+		if err != nil {
+			return nil, err
+		}
+		// policies always keep their readable names, and older opaque infixes are replaced by sealed ones
+		sealed := cryptapi.IsSealedInfix(header.Infix)
+		wantSealed := clerk.Config.OpaqueNames && header.Kind != cryptapi.KindPolicy
+		if header.Epoch < clerk.Config.Epoch || header.KeyVersion < clerk.Config.KeyVersion || sealed != wantSealed {
+			if err := clerk.CheckDeletion(header); err != nil {
+				fmt.Printf("    Retained: %q: %v\n", objectPath, err)
+				continue
+			}
+			stale = append(stale, objectPath)
+		}
+	}
+	return stale, nil
+}
+
+func rekeyRepo() error {
+	configDir, err := getConfigDir(false)
+	if err != nil {
+		return err
+	}
+	prompt := util.Prompter(os.Stdin, os.Stdout)
+	configPath, err := selectConfiguration(configDir, prompt)
+	if err != nil {
+		return err
+	}
+	config, err := cryptapi.ReadConfig(configPath)
+	if err != nil {
+		return err
+	}
+	promptSecret := util.SecretPrompter(prompt, os.Stdin, os.Stdout)
+	newKey, err := promptSecret("New Encryption Key (leave empty to only re-encrypt old objects)> ")
+	if err != nil {
+		return err
+	}
+	if newKey == "" && config.KeyVersion < cryptapi.LatestKeyVersion {
+		upgrade, err := prompt("Upgrade to domain-separated subkeys (y/n)? ")
+		if err != nil {
+			return err
+		}
+		if strings.ToLower(upgrade) == "y" {
+			config.KeyVersion = cryptapi.LatestKeyVersion
+			if _, err := cryptapi.NewClerk(config); err != nil {
+				return err
+			}
+			if err := replaceJSON(config, configPath); err != nil {
+				return err
+			}
+			fmt.Printf("Upgraded to key version %d.\n", config.KeyVersion)
+		}
+	}
+	if newKey != "" {
+		if config, err = cryptapi.RotateKey(config, newKey); err != nil {
+			return err
+		}
+		config.KeyVersion = cryptapi.LatestKeyVersion
+		// make sure the new configuration is usable before saving it
+		if _, err := cryptapi.NewClerk(config); err != nil {
+			return err
+		}
+		if err := replaceJSON(config, configPath); err != nil {
+			return err
+		}
+		fmt.Printf("Rotated to key epoch %d. Other devices must be given the new key before they can read new uploads.\n",
+			config.Epoch)
+	}
+	clerk, err := cryptapi.NewClerk(config)
+	if err != nil {
+		return err
+	}
+	if _, err := clerk.LoadPolicy(0); err != nil {
+		return err
+	}
+	fmt.Println("Scanning this device's objects for ones sealed under older keys...")
+	stale, err := staleObjects(clerk)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Discovered %d objects to re-encrypt.\n", len(stale))
+	if len(stale) == 0 {
+		fmt.Println("Nothing to do.")
+		return nil
+	}
+	ok, err := prompt("Okay to proceed? (Y/N) ")
+	if err != nil {
+		return err
+	}
+	if ok != "Y" && ok != "y" {
+		return fmt.Errorf("not okay to proceed")
+	}
+	api, bucket, err := promptSession(prompt)
+	if err != nil {
+		return err
+	}
+	for _, objectPath := range stale {
+		newPath, err := reencrypt(clerk, objectPath)
+		if err != nil {
+			return err
+		}
+		// delete the old copy right away, so that duplicates are only visible briefly
+		if _, err := api.DeleteObject(&s3.DeleteObjectInput{
+			Bucket: bucket,
+			Key:    aws.String(objectPath),
+		}); err != nil {
+			return fmt.Errorf("re-encrypted %q as %q, but could not delete the original: %w", objectPath, newPath, err)
+		}
+		fmt.Printf("    Replaced: %q -> %q\n", objectPath, newPath)
+	}
+	fmt.Printf("Successfully re-encrypted %d objects under key epoch %d.\n", len(stale), clerk.Config.Epoch)
+	return nil
+}
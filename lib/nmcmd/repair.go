@@ -27,7 +27,7 @@ func repairRepo() error {
 	if err != nil {
 		return err
 	}
-	clerk, err := cryptapi.LoadConfig(configPath)
+	clerk, err := loadClerk(configPath)
 	if err != nil {
 		return err
 	}
@@ -53,11 +53,23 @@ func repairRepo() error {
 		}
 		fmt.Printf("    Passed: %q\n", infix)
 		for _, objectPath := range objectPaths[1:] {
+			header, err := clerk.InspectObject(objectPath)
+			if err != nil {
+				return err
+			}
+			if err := clerk.CheckDeletion(header); err != nil {
+				fmt.Printf("    Retained: %q: %v\n", objectPath, err)
+				continue
+			}
 			deletions = append(deletions, &s3.ObjectIdentifier{
 				Key: aws.String(objectPath),
 			})
 		}
 	}
+	if len(deletions) == 0 {
+		fmt.Println("Nothing to do.")
+		return nil
+	}
 	fmt.Printf("Security validation passed. Preparing to delete %d objects:\n", len(deletions))
 	for _, deletion := range deletions {
 		fmt.Printf("    Object: %q\n", *deletion.Key)
@@ -86,7 +98,8 @@ func repairRepo() error {
 		fmt.Printf("Encountered %d errors while deleting (%d successes):\n", len(output.Errors), len(output.Deleted))
 		for _, deleteErr := range output.Errors {
 			fmt.Printf("    Error: code=%q key=%q description=%q version=%q\n",
-				deleteErr.Code, deleteErr.Key, deleteErr.Message, deleteErr.VersionId)
+				aws.StringValue(deleteErr.Code), aws.StringValue(deleteErr.Key), aws.StringValue(deleteErr.Message),
+				aws.StringValue(deleteErr.VersionId))
 		}
 	} else {
 		fmt.Printf(
@@ -97,6 +110,7 @@ func repairRepo() error {
 }
 
 func promptSession(prompt func(string) (string, error)) (s *s3.S3, bucket *string, err error) {
+	promptSecret := util.SecretPrompter(prompt, os.Stdin, os.Stdout)
 	region, err := prompt("Enter space region (such as 'nyc3'): ")
 	if err != nil {
 		return nil, nil, err
@@ -113,7 +127,7 @@ func promptSession(prompt func(string) (string, error)) (s *s3.S3, bucket *strin
 	if err != nil {
 		return nil, nil, err
 	}
-	secret, err := prompt("Enter full-privilege secret key: ")
+	secret, err := promptSecret("Enter full-privilege secret key: ")
 	if err != nil {
 		return nil, nil, err
 	}
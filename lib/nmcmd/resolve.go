@@ -0,0 +1,135 @@
+package nmcmd
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/celskeggs/nightmarket/lib/githelper"
+)
+
+func gitPush(remote, source, dest string) error {
+	cmd := exec.Command("git", "push", "--", remote, source+":"+dest)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	return cmd.Run()
+}
+
+// resolveConflict merges the competing values of a disputed branch and pushes the merge, and returns false if the
+// dispute could not be resolved automatically.
+func resolveConflict(gitDir, remote string, conflict githelper.Conflict) (bool, error) {
+	var devices []string
+	for _, head := range conflict.Devices {
+		devices = append(devices, head.Device)
+	}
+	if err := conflict.Resolvable(); err != nil {
+		fmt.Printf("Cannot resolve %s: %v.\n", conflict.Ref, err)
+		return false, nil
+	}
+	result, err := githelper.MergeHeads(gitDir, conflict.Heads(), conflict.MergeMessage(), os.Stderr)
+	if err != nil {
+		return false, err
+	}
+	if len(result.Conflicts) > 0 {
+		fmt.Printf("Cannot resolve %s: merging the versions from devices %s conflicts in:\n", conflict.Ref,
+			strings.Join(devices, ", "))
+		for _, file := range result.Conflicts {
+			fmt.Printf("    %s\n", file)
+		}
+		for _, head := range conflict.Devices {
+			fmt.Printf("  Fetch %s to merge the version from device %s by hand.\n", head.RemoteRef, head.Device)
+		}
+		return false, nil
+	}
+	dest, err := conflict.MergedRemoteRef()
+	if err != nil {
+		return false, err
+	}
+	if err := gitPush(remote, result.Commit, dest); err != nil {
+		return false, err
+	}
+	fmt.Printf("Resolved %s by merging the versions from devices %s.\n", conflict.Ref, strings.Join(devices, ", "))
+	return true, nil
+}
+
+func resolveRepo(remoteName string) error {
+	gitDir, err := gitOutput("rev-parse", "--absolute-git-dir")
+	if err != nil {
+		return err
+	}
+	remotes, err := nightmarketRemotes()
+	if err != nil {
+		return err
+	}
+	if remoteName != "" {
+		var found bool
+		for _, remote := range remotes {
+			found = found || remote == remoteName
+		}
+		if !found {
+			return fmt.Errorf("%q is not a nightmarket remote", remoteName)
+		}
+		remotes = []string{remoteName}
+	}
+	if len(remotes) == 0 {
+		return errors.New("no nightmarket remotes are configured in this repository")
+	}
+	var unresolved int
+	for _, remote := range remotes {
+		if err := refreshRemote(remote); err != nil {
+			return fmt.Errorf("while listing remote %q: %w", remote, err)
+		}
+		report, err := githelper.ReadConflictReport(gitDir, remote)
+		if err != nil {
+			return err
+		}
+		if report == nil {
+			return fmt.Errorf("no conflict report was written for remote %q", remote)
+		}
+		if len(report.Conflicts) == 0 {
+			fmt.Printf("Remote %q: no disputed refs.\n", remote)
+		}
+		for _, conflict := range report.Conflicts {
+			resolved, err := resolveConflict(gitDir, remote, conflict)
+			if err != nil {
+				return err
+			}
+			if !resolved {
+				unresolved++
+			}
+		}
+	}
+	if unresolved > 0 {
+		return fmt.Errorf("%d disputed refs must be resolved by hand", unresolved)
+	}
+	return nil
+}
+
+func resolveAuto(enable bool) error {
+	cmd := exec.Command("git", "config", "--type=bool", "--", githelper.AutoResolveKey, fmt.Sprint(enable))
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return err
+	}
+	if enable {
+		fmt.Println("Disputed branches will be merged automatically during fetches, when they merge cleanly.")
+	} else {
+		fmt.Println("Disputed branches will no longer be merged automatically.")
+	}
+	return nil
+}
+
+func resolveCommand(args []string) error {
+	switch {
+	case len(args) == 0:
+		return resolveRepo("")
+	case len(args) == 2 && args[0] == "--auto" && (args[1] == "on" || args[1] == "off"):
+		return resolveAuto(args[1] == "on")
+	case len(args) == 1 && !strings.HasPrefix(args[0], "-"):
+		return resolveRepo(args[0])
+	default:
+		return errors.New("expected: resolve [<remote>] | resolve --auto on|off")
+	}
+}
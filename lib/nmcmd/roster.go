@@ -0,0 +1,153 @@
+package nmcmd
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"filippo.io/age"
+	"github.com/celskeggs/nightmarket/lib/cryptapi"
+	"github.com/celskeggs/nightmarket/lib/util"
+)
+
+func readTrimmedFile(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+func rosterKeygen() error {
+	public, private, err := cryptapi.GenerateSigningKey()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Admin public key (configure as admin-key on every device):\n%s\n", public)
+	fmt.Printf("\nAdmin private key (store offline; used only to sign rosters):\n%s\n", private)
+	return nil
+}
+
+func rosterIdentity() error {
+	identity, err := age.GenerateX25519Identity()
+	if err != nil {
+		return err
+	}
+	verifyKey, signingKey, err := cryptapi.GenerateSigningKey()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Device recipient (add to the roster):\n%s\n", identity.Recipient().String())
+	fmt.Printf("\nDevice verify key (add to the roster):\n%s\n", verifyKey)
+	fmt.Printf("\nDevice identity (keep secret; enter during roster install):\n%s\n", identity.String())
+	fmt.Printf("\nDevice signing key (keep secret; enter during roster install):\n%s\n", signingKey)
+	return nil
+}
+
+func rosterSign(adminKeyPath, rosterPath string) error {
+	adminKey, err := readTrimmedFile(adminKeyPath)
+	if err != nil {
+		return err
+	}
+	rosterData, err := os.ReadFile(rosterPath)
+	if err != nil {
+		return err
+	}
+	var roster cryptapi.Roster
+	if err := json.Unmarshal(rosterData, &roster); err != nil {
+		return err
+	}
+	signed, err := cryptapi.SignRoster(roster, adminKey)
+	if err != nil {
+		return err
+	}
+	for device, entry := range roster.Devices {
+		if entry.VerifyKey != "" && entry.SignedFromMs == 0 {
+			_, _ = fmt.Fprintf(os.Stderr, "note: device %q has no signed-from-ms, so any unsigned objects that it "+
+				"uploaded before it had a verify key will be rejected; set it to %d to accept objects older than now\n",
+				device, time.Now().UnixMilli())
+		}
+	}
+	return json.NewEncoder(os.Stdout).Encode(signed)
+}
+
+func rosterInstall(signedRosterPath string) error {
+	signedData, err := os.ReadFile(signedRosterPath)
+	if err != nil {
+		return err
+	}
+	var signed cryptapi.SignedRoster
+	if err := json.Unmarshal(signedData, &signed); err != nil {
+		return err
+	}
+	configDir, err := getConfigDir(false)
+	if err != nil {
+		return err
+	}
+	prompt := util.Prompter(os.Stdin, os.Stdout)
+	configPath, err := selectConfiguration(configDir, prompt)
+	if err != nil {
+		return err
+	}
+	config, err := cryptapi.ReadConfig(configPath)
+	if err != nil {
+		return err
+	}
+	promptSecret := util.SecretPrompter(prompt, os.Stdin, os.Stdout)
+	if config.AdminKey == "" {
+		if config.AdminKey, err = prompt("Admin Public Key> "); err != nil {
+			return err
+		}
+	}
+	roster, err := signed.Verify(config.AdminKey)
+	if err != nil {
+		return err
+	}
+	if config.Roster != nil {
+		// refuse to roll back to an older roster, which might re-admit a removed device
+		if previous, err := config.Roster.Verify(config.AdminKey); err == nil && roster.Serial <= previous.Serial {
+			return fmt.Errorf("roster serial %d is not newer than installed serial %d", roster.Serial, previous.Serial)
+		}
+	}
+	config.Roster = &signed
+	if config.Identity == "" {
+		if config.Identity, err = promptSecret("Device Identity> "); err != nil {
+			return err
+		}
+	}
+	if entry, found := roster.Devices[config.SpaceConfig.DeviceName]; found && entry.VerifyKey != "" {
+		if config.SigningKey == "" {
+			if config.SigningKey, err = promptSecret("Device Signing Key> "); err != nil {
+				return err
+			}
+		}
+	}
+	// make sure the new configuration is usable before saving it
+	if _, err := cryptapi.NewClerk(config); err != nil {
+		return err
+	}
+	if err := replaceJSON(config, configPath); err != nil {
+		return err
+	}
+	fmt.Printf("Installed roster serial %d with %d devices.\n", roster.Serial, len(roster.Devices))
+	return nil
+}
+
+func rosterCommand(args []string) error {
+	switch {
+	case len(args) == 1 && args[0] == "keygen":
+		return rosterKeygen()
+	case len(args) == 1 && args[0] == "identity":
+		return rosterIdentity()
+	case len(args) == 3 && args[0] == "sign":
+		return rosterSign(args[1], args[2])
+	case len(args) == 2 && args[0] == "install":
+		return rosterInstall(args[1])
+	default:
+		return errors.New("expected: roster keygen | roster identity | roster sign <admin-key-file> <roster-file> | " +
+			"roster install <signed-roster-file>")
+	}
+}
@@ -0,0 +1,120 @@
+package nmcmd
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/celskeggs/nightmarket/lib/githelper"
+)
+
+const remoteURLPrefix = "nightmarket::"
+
+func gitOutput(args ...string) (string, error) {
+	cmd := exec.Command("git", args...)
+	cmd.Stderr = os.Stderr
+	output, err := cmd.Output()
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(output)), nil
+}
+
+// nightmarketRemotes lists the remotes of the current repository that use the git remote helper.
+func nightmarketRemotes() ([]string, error) {
+	output, err := gitOutput("remote")
+	if err != nil {
+		return nil, err
+	}
+	var remotes []string
+	for _, remote := range strings.Fields(output) {
+		url, err := gitOutput("remote", "get-url", "--", remote)
+		if err != nil {
+			return nil, err
+		}
+		if strings.HasPrefix(url, remoteURLPrefix) {
+			remotes = append(remotes, remote)
+		}
+	}
+	return remotes, nil
+}
+
+// refreshRemote lists the refs of a remote, which brings the remote helper's refdb and conflict report up to date
+// without changing any local refs. Automatic resolution is disabled, because it would push merges to the remote.
+func refreshRemote(remote string) error {
+	cmd := exec.Command("git", "-c", githelper.AutoResolveKey+"=false", "ls-remote", "--quiet", "--", remote)
+	cmd.Stderr = os.Stderr
+	return cmd.Run()
+}
+
+func printConflictReport(remote string, report *githelper.ConflictReport) {
+	if len(report.Conflicts) == 0 {
+		fmt.Printf("Remote %q: no disputed refs.\n", remote)
+		return
+	}
+	fmt.Printf("Remote %q: disputed refs: %d\n", remote, len(report.Conflicts))
+	for _, conflict := range report.Conflicts {
+		since := conflict.Since
+		if since == "" {
+			since = "an unknown pack"
+		}
+		fmt.Printf("\n  %s (disputed since %s):\n", conflict.Ref, since)
+		for _, head := range conflict.Devices {
+			pack := head.Pack
+			if pack == "" {
+				pack = "unknown"
+			}
+			fmt.Printf("    %-12s %s  pack %s  fetch as %s\n", head.Device, head.Sha1, pack, head.RemoteRef)
+		}
+	}
+}
+
+func statusRepo(asJSON bool) error {
+	gitDir, err := gitOutput("rev-parse", "--absolute-git-dir")
+	if err != nil {
+		return err
+	}
+	remotes, err := nightmarketRemotes()
+	if err != nil {
+		return err
+	}
+	if len(remotes) == 0 {
+		return errors.New("no nightmarket remotes are configured in this repository")
+	}
+	var reports []*githelper.ConflictReport
+	for _, remote := range remotes {
+		if err := refreshRemote(remote); err != nil {
+			return fmt.Errorf("while listing remote %q: %w", remote, err)
+		}
+		report, err := githelper.ReadConflictReport(gitDir, remote)
+		if err != nil {
+			return err
+		}
+		if report == nil {
+			return fmt.Errorf("no conflict report was written for remote %q", remote)
+		}
+		if asJSON {
+			reports = append(reports, report)
+		} else {
+			printConflictReport(remote, report)
+		}
+	}
+	if asJSON {
+		return json.NewEncoder(os.Stdout).Encode(reports)
+	}
+	return nil
+}
+
+func statusCommand(args []string) error {
+	switch {
+	case len(args) == 0:
+		return statusRepo(false)
+	case len(args) == 1 && args[0] == "--json":
+		return statusRepo(true)
+	default:
+		return errors.New("expected: status [--json]")
+	}
+}
@@ -0,0 +1,208 @@
+package nmcmd
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"runtime"
+	"strconv"
+	"time"
+
+	"github.com/celskeggs/nightmarket/lib/cryptapi"
+	"github.com/celskeggs/nightmarket/lib/util"
+	"golang.org/x/crypto/argon2"
+)
+
+// limits of the watchdemon authenticate action, from watchdemon/project.yml
+const authenticateTimeout = 5 * time.Second
+const authenticateMemoryMB = 128
+
+// leave room in the authenticate action for the rest of the request and the Go runtime
+const maxTokenMegabytes = authenticateMemoryMB / 2
+const minTokenMegabytes = 8
+const maxTokenTarget = authenticateTimeout / 2
+
+const defaultTokenTarget = time.Second
+
+// project.yml cannot request more than one core for the authenticate action
+const defaultRuntimeCores = 1
+const maxRuntimeCores = 16
+
+// tokenHelp states what calibration assumes about the function runtime, since it can only be measured locally.
+const tokenHelp = "calibration runs on this machine, restricted to the runtime's cores, and assumes that each of " +
+	"those cores is as fast as one of this machine's; if the function runtime is slower, pass a smaller target-ms"
+
+type argon2Params struct {
+	Iterations  uint32
+	Megabytes   uint32
+	Parallelism uint8
+}
+
+const (
+	tokenLength = 128
+	saltLength  = 16
+	keyLength   = 32
+)
+
+// encodeArgon2Hash produces the same encoding as github.com/alexedwards/argon2id, which watchdemon uses to verify.
+func encodeArgon2Hash(token string, params argon2Params) (string, error) {
+	salt := make([]byte, saltLength)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	key := argon2.IDKey([]byte(token), salt, params.Iterations, params.Megabytes*1024, params.Parallelism, keyLength)
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s", argon2.Version,
+		params.Megabytes*1024, params.Iterations, params.Parallelism,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+func timeArgon2(params argon2Params) time.Duration {
+	start := time.Now()
+	argon2.IDKey([]byte("calibration"), make([]byte, saltLength),
+		params.Iterations, params.Megabytes*1024, params.Parallelism, keyLength)
+	return time.Since(start)
+}
+
+// calibrateArgon2 finds the most expensive parameters whose verification time on a runtime with the given number of
+// cores does not exceed the target.
+func calibrateArgon2(target time.Duration, cores int) (argon2Params, time.Duration, error) {
+	// argon2 computes its lanes concurrently, so limit them to the cores that the runtime will have
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(cores))
+	var best argon2Params
+	var bestElapsed time.Duration
+	var err error
+	for parallelism := 1; parallelism <= cores; parallelism *= 2 {
+		params, elapsed, perr := calibrateLanes(target, uint8(parallelism))
+		if perr != nil {
+			err = perr
+			continue
+		}
+		// the cost of an attack grows with the total memory filled, which more lanes can fill in less time
+		if uint64(params.Iterations)*uint64(params.Megabytes) > uint64(best.Iterations)*uint64(best.Megabytes) {
+			best, bestElapsed = params, elapsed
+		}
+	}
+	if best.Iterations == 0 {
+		return argon2Params{}, 0, err
+	}
+	return best, bestElapsed, nil
+}
+
+// calibrateLanes finds the most expensive parameters with a fixed parallelism that do not exceed the target.
+func calibrateLanes(target time.Duration, parallelism uint8) (argon2Params, time.Duration, error) {
+	params := argon2Params{
+		Iterations:  1,
+		Megabytes:   maxTokenMegabytes,
+		Parallelism: parallelism,
+	}
+	elapsed := timeArgon2(params)
+	// if a single pass over the maximum memory is already too slow, use less memory
+	for elapsed > target && params.Megabytes > minTokenMegabytes {
+		params.Megabytes /= 2
+		elapsed = timeArgon2(params)
+	}
+	if elapsed > target {
+		return argon2Params{}, 0, fmt.Errorf("cannot reach target time %v: minimal parameters took %v", target, elapsed)
+	}
+	// then add iterations until the next one would exceed the target
+	for {
+		perIteration := elapsed / time.Duration(params.Iterations)
+		if elapsed+perIteration > target || params.Iterations >= 255 {
+			break
+		}
+		next := params
+		next.Iterations++
+		nextElapsed := timeArgon2(next)
+		if nextElapsed > target {
+			break
+		}
+		params, elapsed = next, nextElapsed
+	}
+	return params, elapsed, nil
+}
+
+func generateToken(device string, target time.Duration, cores int) error {
+	if device == "" {
+		return errors.New("device name cannot be empty")
+	}
+	if target <= 0 || target > maxTokenTarget {
+		return fmt.Errorf("target time must be positive and at most %v to fit the authenticate action's limits",
+			maxTokenTarget)
+	}
+	if cores < 1 || cores > maxRuntimeCores {
+		return fmt.Errorf("runtime cores must be between 1 and %d", maxRuntimeCores)
+	}
+	fmt.Printf("Calibrating argon2id for a verification time of %v on %d core(s)...\n", target, cores)
+	fmt.Printf("Note: %s.\n", tokenHelp)
+	params, elapsed, err := calibrateArgon2(target, cores)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Selected iterations=%d megabytes=%d parallelism=%d (%v locally)\n",
+		params.Iterations, params.Megabytes, params.Parallelism, elapsed.Round(time.Millisecond))
+	tokenBytes := make([]byte, tokenLength)
+	if _, err := rand.Read(tokenBytes); err != nil {
+		return err
+	}
+	token := base64.StdEncoding.EncodeToString(tokenBytes)
+	hash, err := encodeArgon2Hash(token, params)
+	if err != nil {
+		return err
+	}
+	snippet, err := json.Marshal(map[string]string{device: hash})
+	if err != nil {
+		return err
+	}
+	fmt.Printf("\nDevice token for %q (enter this as the Device Token during init; keep it secret):\n%s\n",
+		device, token)
+	fmt.Printf("\nAdd this entry to WATCHDEMON_AUTHORIZED:\n%s\n", string(snippet))
+	return nil
+}
+
+// printDeviceAlias shows the alias under which a device must be registered when device names are hidden.
+func printDeviceAlias(device string) error {
+	promptSecret := util.SecretPrompter(util.Prompter(os.Stdin, os.Stdout), os.Stdin, os.Stdout)
+	aliasKey, err := promptSecret("Device Alias Key> ")
+	if err != nil {
+		return err
+	}
+	if aliasKey == "" {
+		return errors.New("device alias key cannot be empty")
+	}
+	alias, err := cryptapi.DeviceAlias(aliasKey, device)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Device %q is registered with the watchdemon as:\n%s\n", device, alias)
+	fmt.Printf("Generate its token with: token generate %s\n", alias)
+	return nil
+}
+
+func tokenCommand(args []string) error {
+	if len(args) == 2 && args[0] == "alias" {
+		return printDeviceAlias(args[1])
+	}
+	if len(args) < 2 || len(args) > 4 || args[0] != "generate" {
+		return errors.New("expected: token generate <device> [target-ms [runtime-cores]] | token alias <device>")
+	}
+	target := defaultTokenTarget
+	if len(args) >= 3 {
+		ms, err := strconv.ParseUint(args[2], 10, 32)
+		if err != nil {
+			return err
+		}
+		target = time.Duration(ms) * time.Millisecond
+	}
+	cores := defaultRuntimeCores
+	if len(args) == 4 {
+		n, err := strconv.ParseUint(args[3], 10, 8)
+		if err != nil {
+			return err
+		}
+		cores = int(n)
+	}
+	return generateToken(args[1], target, cores)
+}
@@ -0,0 +1,73 @@
+package util
+
+import (
+	"fmt"
+	"strings"
+)
+
+// ClientVersion identifies this release of nightmarket. It is recorded in the objects it writes, so that readers can
+// explain which client produced data that they cannot understand.
+const ClientVersion = "0.3.0"
+
+// Compatibility is embedded in versioned headers to describe what a reader needs in order to understand them.
+//
+// A reader accepts data if the data's minimum version is within the range of versions it supports and it knows every
+// required feature. Optional features may be ignored by readers that do not know them. Readers that predate this
+// scheme only check the version itself, so writers that rely on a minimum version or required feature must also raise
+// the version beyond the last format that did not have this scheme.
+type Compatibility struct {
+	// the oldest format version that a reader can support and still read this data; defaults to the version itself
+	MinVersion int      `json:"min-version,omitempty"`
+	Required   []string `json:"requires,omitempty"`
+	Optional   []string `json:"extensions,omitempty"`
+	// the ClientVersion of the writer, for diagnostics
+	Client string `json:"client,omitempty"`
+}
+
+// FormatReader describes the versions and features that a reader of some format supports.
+type FormatReader struct {
+	// what the format is called in error messages, such as "object"
+	Name     string
+	Oldest   int
+	Newest   int
+	Features []string
+}
+
+func (c Compatibility) writer() string {
+	if c.Client == "" {
+		return "an unknown nightmarket client"
+	}
+	return "nightmarket " + c.Client
+}
+
+// Check reports a descriptive error if data of this version and compatibility cannot be read.
+func (r FormatReader) Check(version int, c Compatibility) error {
+	minVersion := c.MinVersion
+	if minVersion == 0 || minVersion > version {
+		minVersion = version
+	}
+	if version < r.Oldest {
+		return fmt.Errorf("%s has format version %d (written by %s), which is older than the oldest version %d "+
+			"supported by nightmarket %s", r.Name, version, c.writer(), r.Oldest, ClientVersion)
+	}
+	if minVersion > r.Newest {
+		return fmt.Errorf("%s needs a client that reads format version %d (written by %s), but nightmarket %s only "+
+			"reads versions %d through %d: upgrade nightmarket to read it", r.Name, minVersion, c.writer(),
+			ClientVersion, r.Oldest, r.Newest)
+	}
+	var missing []string
+	for _, feature := range c.Required {
+		var known bool
+		for _, supported := range r.Features {
+			known = known || feature == supported
+		}
+		if !known {
+			missing = append(missing, feature)
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("%s requires features [%s] (written by %s), which nightmarket %s does not support: upgrade "+
+			"nightmarket to read it", r.Name, strings.Join(missing, ", "), c.writer(), ClientVersion)
+	}
+	return nil
+}
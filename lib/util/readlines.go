@@ -4,6 +4,9 @@ import (
 	"bufio"
 	"errors"
 	"io"
+	"os"
+
+	"golang.org/x/term"
 )
 
 func ReadLines(in io.Reader) func() (string, error) {
@@ -20,8 +23,35 @@ func ReadLines(in io.Reader) func() (string, error) {
 	}
 }
 
+// readLinesUnbuffered is like ReadLines, but never reads past the end of the current line, so that the rest of the
+// input remains available to other readers of the same file.
+func readLinesUnbuffered(in io.Reader) func() (string, error) {
+	return func() (string, error) {
+		var line []byte
+		b := make([]byte, 1)
+		for {
+			n, err := in.Read(b)
+			if n == 1 {
+				if b[0] == '\n' {
+					return string(line), nil
+				}
+				line = append(line, b[0])
+			} else if err != nil {
+				return "", err
+			}
+		}
+	}
+}
+
+// Prompter asks questions on out and reads each reply as a line from in. Terminals are read without buffering ahead,
+// so that SecretPrompter can read passphrases from the same terminal without losing any input.
 func Prompter(in io.Reader, out io.Writer) func(string) (string, error) {
-	reader := ReadLines(in)
+	var reader func() (string, error)
+	if f, ok := in.(*os.File); ok && term.IsTerminal(int(f.Fd())) {
+		reader = readLinesUnbuffered(f)
+	} else {
+		reader = ReadLines(in)
+	}
 	return func(prompt string) (string, error) {
 		_, err := out.Write([]byte(prompt))
 		if err == io.EOF {
@@ -0,0 +1,36 @@
+package util
+
+import (
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestReadLinesUnbuffered(t *testing.T) {
+	in := strings.NewReader("first\nsecret\n")
+	line, err := readLinesUnbuffered(in)()
+	if err != nil || line != "first" {
+		t.Fatalf("read %q: %v", line, err)
+	}
+	// the rest must still be available to another reader, as it is to term.ReadPassword
+	rest, err := io.ReadAll(in)
+	if err != nil || string(rest) != "secret\n" {
+		t.Errorf("input after the first line was consumed: %q, %v", rest, err)
+	}
+}
+
+func TestPrompter(t *testing.T) {
+	var out strings.Builder
+	prompt := Prompter(strings.NewReader("yes\nsecret\n"), &out)
+	secretPrompt := SecretPrompter(prompt, nil, &out)
+	if reply, err := prompt("Continue? "); err != nil || reply != "yes" {
+		t.Errorf("prompt read %q: %v", reply, err)
+	}
+	// input that is not a terminal is read through the same reader as every other prompt
+	if reply, err := secretPrompt("Key> "); err != nil || reply != "secret" {
+		t.Errorf("secret prompt read %q: %v", reply, err)
+	}
+	if out.String() != "Continue? Key> " {
+		t.Errorf("unexpected prompts %q", out.String())
+	}
+}
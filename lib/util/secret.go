@@ -0,0 +1,54 @@
+package util
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"golang.org/x/term"
+)
+
+// SecretPrompter wraps a prompt function so that, when in is a terminal, replies are read without being echoed.
+// Otherwise, replies are read through prompt, so that every reply comes from the same buffered reader. prompt should
+// come from Prompter on the same input, which does not read ahead on terminals.
+func SecretPrompter(prompt func(string) (string, error), in *os.File, out io.Writer) func(string) (string, error) {
+	return func(question string) (string, error) {
+		fd := int(in.Fd())
+		if !term.IsTerminal(fd) {
+			return prompt(question)
+		}
+		if _, err := out.Write([]byte(question)); err != nil {
+			return "", err
+		}
+		secret, err := term.ReadPassword(fd)
+		if _, err2 := out.Write([]byte("\n")); err2 != nil && err == nil {
+			err = err2
+		}
+		if err != nil {
+			return "", err
+		}
+		return string(secret), nil
+	}
+}
+
+// PromptTerminal asks for a secret on the controlling terminal, which works even when stdin and stdout are in use
+// for something else (such as when running as a git remote helper).
+func PromptTerminal(question string) (string, error) {
+	tty, err := os.OpenFile("/dev/tty", os.O_RDWR, 0)
+	if err != nil {
+		return "", errors.New("no terminal available to prompt for a secret")
+	}
+	defer func() {
+		_ = tty.Close()
+	}()
+	if _, err := fmt.Fprint(tty, question); err != nil {
+		return "", err
+	}
+	secret, err := term.ReadPassword(int(tty.Fd()))
+	_, _ = fmt.Fprintln(tty)
+	if err != nil {
+		return "", err
+	}
+	return string(secret), nil
+}
@@ -25,6 +25,21 @@ type ReplyError struct {
 	Error string `json:"error"`
 }
 
+// ProtocolVersion is bumped whenever the request or reply format changes in a way that clients need to know about.
+const ProtocolVersion = 2
+
+// MinProtocolVersion is the oldest client protocol version that this server still answers correctly.
+const MinProtocolVersion = 1
+
+const presignExpiry = time.Second * 10
+
+type Capabilities struct {
+	Protocol       int   `json:"protocol"`
+	MinProtocol    int   `json:"min-protocol"`
+	ServerTimeMs   int64 `json:"server-time-ms"`
+	PresignSeconds int   `json:"presign-seconds"`
+}
+
 func response(data interface{}) map[string]interface{} {
 	encoded, err := json.Marshal(data)
 	if err != nil {
@@ -37,6 +52,15 @@ func response(data interface{}) map[string]interface{} {
 }
 
 func Main(in map[string]interface{}) (out map[string]interface{}) {
+	// capabilities reveal nothing secret, so they do not require the (slow) token check
+	if mode, _ := in["mode"].(string); mode == "Capabilities" {
+		return response(Capabilities{
+			Protocol:       ProtocolVersion,
+			MinProtocol:    MinProtocolVersion,
+			ServerTimeMs:   time.Now().UnixNano() / int64(time.Millisecond),
+			PresignSeconds: int(presignExpiry / time.Second),
+		})
+	}
 	device, ok1 := in["device"].(string)
 	token, ok2 := in["token"].(string)
 	mode, ok3 := in["mode"].(string)
@@ -123,7 +147,7 @@ func Main(in map[string]interface{}) (out map[string]interface{}) {
 	default:
 		return response(ReplyError{"invalid request mode"})
 	}
-	r.URL, r.Headers, err = req.PresignRequest(time.Second * 10)
+	r.URL, r.Headers, err = req.PresignRequest(presignExpiry)
 	if err != nil {
 		return response(ReplyError{"presign error: " + err.Error()})
 	}
@@ -1,5 +0,0 @@
-module github.com/celskeggs/nightmarket/watchdemon/packages/watchdemon/generate
-
-go 1.16
-
-require github.com/alexedwards/argon2id v0.0.0-20211130144151-3585854a6387